@@ -316,6 +316,50 @@ func testDBIterator(t *testing.T, backend BackendType) {
 	verifyIterator(t, ritr, nil, "reverse iterator with empty db")
 }
 
+func TestDBIteratorEmptyBounds(t *testing.T) {
+	testCases := []struct {
+		name       string
+		start, end []byte
+		err        error
+	}{
+		{"nil-nil", nil, nil, nil},
+		{"empty-nil", []byte{}, nil, errKeyEmpty},
+		{"nil-empty", nil, []byte{}, errKeyEmpty},
+		{"start-empty", []byte{0x01}, []byte{}, errKeyEmpty},
+		{"normalized", NormalizeBound([]byte{}), NormalizeBound([]byte{0x01}), nil},
+	}
+	for backend := range backends {
+		t.Run(string(backend), func(t *testing.T) {
+			db, dir := newTempDB(t, backend)
+			defer os.RemoveAll(dir)
+			defer db.Close()
+			require.NoError(t, db.Set([]byte{0x00}, []byte{1}))
+
+			for _, tc := range testCases {
+				for _, newIterator := range []func(start, end []byte) (Iterator, error){
+					db.Iterator, db.ReverseIterator,
+				} {
+					itr, err := newIterator(tc.start, tc.end)
+					require.Equal(t, tc.err, err, tc.name)
+					if err == nil {
+						require.True(t, itr.Valid(), tc.name)
+						require.NoError(t, itr.Close())
+					}
+				}
+			}
+
+			// A prefix has no unbounded side to express: nil and empty both
+			// mean every key.
+			for _, prefix := range [][]byte{nil, {}} {
+				itr, err := IteratePrefix(db, prefix)
+				require.NoError(t, err)
+				require.True(t, itr.Valid())
+				require.NoError(t, itr.Close())
+			}
+		})
+	}
+}
+
 func verifyIterator(t *testing.T, itr Iterator, expected []int64, msg string) {
 	var list []int64
 	for itr.Valid() {
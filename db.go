@@ -25,6 +25,17 @@ const (
 	//   - pure go
 	//   - use pebble build tag (go build -tags pebbledb)
 	PebbleDBBackend BackendType = "pebbledb"
+	// PostgresBackend represents PostgreSQL (uses github.com/lib/pq)
+	//   - requires a running server, whose connection string is passed in
+	//     the dsn option
+	//   - use postgres build tag (go build -tags postgres)
+	PostgresBackend BackendType = "postgres"
+	// SQLBackend represents any database/sql driver (see NewSQLDb)
+	//   - the driver option names the driver, sqlite3 by default, whose
+	//     package must be imported
+	//   - the dsn option is passed to the driver; with sqlite3 it defaults to
+	//     a database file in dir
+	SQLBackend BackendType = "sql"
 
 	SqliteBackend BackendType = "sqlite"
 )
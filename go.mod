@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/cockroachdb/pebble v1.1.0
 	github.com/google/btree v1.1.2
+	github.com/lib/pq v1.10.9
 	github.com/linxGnu/grocksdb v1.8.12
 	github.com/mattn/go-sqlite3 v1.14.24
 	github.com/spf13/cast v1.6.0
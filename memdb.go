@@ -182,7 +182,7 @@ func (db *MemDB) NewBatchWithSize(_ int) Batch {
 // Iterator implements DB.
 // Takes out a read-lock on the database until the iterator is closed.
 func (db *MemDB) Iterator(start, end []byte) (Iterator, error) {
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+	if !isValidDomain(start, end) {
 		return nil, errKeyEmpty
 	}
 	return newMemDBIterator(db, start, end, false), nil
@@ -191,7 +191,7 @@ func (db *MemDB) Iterator(start, end []byte) (Iterator, error) {
 // ReverseIterator implements DB.
 // Takes out a read-lock on the database until the iterator is closed.
 func (db *MemDB) ReverseIterator(start, end []byte) (Iterator, error) {
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+	if !isValidDomain(start, end) {
 		return nil, errKeyEmpty
 	}
 	return newMemDBIterator(db, start, end, true), nil
@@ -199,7 +199,7 @@ func (db *MemDB) ReverseIterator(start, end []byte) (Iterator, error) {
 
 // IteratorNoMtx makes an iterator with no mutex.
 func (db *MemDB) IteratorNoMtx(start, end []byte) (Iterator, error) {
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+	if !isValidDomain(start, end) {
 		return nil, errKeyEmpty
 	}
 	return newMemDBIteratorMtxChoice(db, start, end, false, false), nil
@@ -207,7 +207,7 @@ func (db *MemDB) IteratorNoMtx(start, end []byte) (Iterator, error) {
 
 // ReverseIteratorNoMtx makes an iterator with no mutex.
 func (db *MemDB) ReverseIteratorNoMtx(start, end []byte) (Iterator, error) {
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+	if !isValidDomain(start, end) {
 		return nil, errKeyEmpty
 	}
 	return newMemDBIteratorMtxChoice(db, start, end, true, false), nil
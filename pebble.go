@@ -241,7 +241,7 @@ func (db *PebbleDB) NewBatchWithSize(size int) Batch {
 // Iterator implements DB.
 func (db *PebbleDB) Iterator(start, end []byte) (Iterator, error) {
 	// fmt.Println("PebbleDB.Iterator")
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+	if !isValidDomain(start, end) {
 		return nil, errKeyEmpty
 	}
 	o := pebble.IterOptions{
@@ -260,7 +260,7 @@ func (db *PebbleDB) Iterator(start, end []byte) (Iterator, error) {
 // ReverseIterator implements DB.
 func (db *PebbleDB) ReverseIterator(start, end []byte) (Iterator, error) {
 	// fmt.Println("PebbleDB.ReverseIterator")
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+	if !isValidDomain(start, end) {
 		return nil, errKeyEmpty
 	}
 	o := pebble.IterOptions{
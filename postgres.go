@@ -0,0 +1,49 @@
+//go:build postgres
+// +build postgres
+
+package db
+
+import (
+	"errors"
+
+	_ "github.com/lib/pq" // registers the postgres driver
+	"github.com/spf13/cast"
+)
+
+func init() {
+	dbCreator := func(name string, dir string, opts Options) (DB, error) {
+		return NewPostgresDb(name, dir, opts)
+	}
+	registerDBCreator(PostgresBackend, dbCreator, false)
+}
+
+// PostgresDb is a PostgreSQL backend: a SQLDb with the PostgreSQL dialect.
+// Keys and values are stored in a table with bytea columns, which PostgreSQL
+// orders bytewise like bytes.Compare.
+type PostgresDb struct {
+	*SQLDb
+}
+
+var _ DB = (*PostgresDb)(nil)
+
+// NewPostgresDb connects to the PostgreSQL server and creates the table if
+// needed. The name and dir arguments are not used: the server is chosen by the
+// connection string. Recognized opts keys:
+//
+//	dsn    string  connection string, as accepted by github.com/lib/pq; required
+//	table  string  name of the table holding the entries, default state_storage
+func NewPostgresDb(name string, dir string, opts Options) (*PostgresDb, error) {
+	if opts == nil {
+		return nil, errors.New("missing dsn option for the postgres backend")
+	}
+	dsn := cast.ToString(opts.Get("dsn"))
+	if dsn == "" {
+		return nil, errors.New("missing dsn option for the postgres backend")
+	}
+
+	db, err := NewSQLDb("postgres", dsn, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresDb{SQLDb: db}, nil
+}
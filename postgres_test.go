@@ -0,0 +1,92 @@
+//go:build postgres
+// +build postgres
+
+package db
+
+import (
+	"bytes"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// postgresTestDSN names the environment variable holding the connection
+// string of the server used by the tests. Without it, the postgres backend is
+// left out of the backend-wide tests and its own tests are skipped.
+const postgresTestDSN = "COSMOS_DB_POSTGRES_DSN"
+
+func init() {
+	dsn := os.Getenv(postgresTestDSN)
+	if dsn == "" {
+		delete(backends, PostgresBackend)
+		return
+	}
+	// Give each test database its own, empty table, since they all live on
+	// the same server.
+	registerDBCreator(PostgresBackend, func(name, dir string, opts Options) (DB, error) {
+		table := "state_storage_" + regexp.MustCompile(`[^a-z0-9_]`).ReplaceAllString(strings.ToLower(name), "_")
+		db, err := NewPostgresDb(name, dir, OptionsMap{"dsn": dsn, "table": table})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.db.Exec("TRUNCATE " + db.table); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+		return db, nil
+	}, true)
+}
+
+func newTestPostgresDb(t *testing.T) *PostgresDb {
+	t.Helper()
+	if os.Getenv(postgresTestDSN) == "" {
+		t.Skipf("%s is not set", postgresTestDSN)
+	}
+	db, err := NewDB(t.Name(), PostgresBackend, "")
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	return db.(*PostgresDb)
+}
+
+func TestPostgresOptions(t *testing.T) {
+	_, err := NewPostgresDb("testdb", "", nil)
+	require.Error(t, err)
+	_, err = NewPostgresDb("testdb", "", OptionsMap{"dsn": "postgres://localhost/db", "table": "state; DROP"})
+	require.Error(t, err)
+}
+
+func TestPostgresBinaryKeyOrder(t *testing.T) {
+	db := newTestPostgresDb(t)
+	keys := [][]byte{
+		{0x41}, {0xff}, {0x00, 0x01}, {0x00}, {0x41, 0x00, 0x42}, {0xc3, 0x28}, {0x00, 0x00}, {0x7f, 0xff},
+	}
+	for _, key := range keys {
+		require.NoError(t, db.Set(key, append([]byte{0x00}, key...)))
+	}
+	sorted := slices.Clone(keys)
+	slices.SortFunc(sorted, bytes.Compare)
+
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	var got [][]byte
+	for ; itr.Valid(); itr.Next() {
+		require.Equal(t, append([]byte{0x00}, itr.Key()...), itr.Value())
+		got = append(got, itr.Key())
+	}
+	require.NoError(t, itr.Error())
+	require.NoError(t, itr.Close())
+	require.Equal(t, sorted, got)
+
+	itr, err = db.ReverseIterator([]byte{0x00, 0x01}, []byte{0xc3, 0x28})
+	require.NoError(t, err)
+	got = nil
+	for ; itr.Valid(); itr.Next() {
+		got = append(got, itr.Key())
+	}
+	require.NoError(t, itr.Close())
+	require.Equal(t, [][]byte{{0x7f, 0xff}, {0x41, 0x00, 0x42}, {0x41}, {0x00, 0x01}}, got)
+}
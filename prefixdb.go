@@ -98,7 +98,7 @@ func (pdb *PrefixDB) DeleteSync(key []byte) error {
 
 // Iterator implements DB.
 func (pdb *PrefixDB) Iterator(start, end []byte) (Iterator, error) {
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+	if !isValidDomain(start, end) {
 		return nil, errKeyEmpty
 	}
 
@@ -119,7 +119,7 @@ func (pdb *PrefixDB) Iterator(start, end []byte) (Iterator, error) {
 
 // ReverseIterator implements DB.
 func (pdb *PrefixDB) ReverseIterator(start, end []byte) (Iterator, error) {
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+	if !isValidDomain(start, end) {
 		return nil, errKeyEmpty
 	}
 
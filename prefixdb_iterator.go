@@ -6,7 +6,7 @@ import (
 )
 
 // IteratePrefix is a convenience function for iterating over a key domain
-// restricted by prefix.
+// restricted by prefix. A nil or empty prefix iterates over every key.
 func IteratePrefix(db DB, prefix []byte) (Iterator, error) {
 	var start, end []byte
 	if len(prefix) == 0 {
@@ -198,7 +198,7 @@ func (db *RocksDB) NewBatchWithSize(_ int) Batch {
 
 // Iterator implements DB.
 func (db *RocksDB) Iterator(start, end []byte) (Iterator, error) {
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+	if !isValidDomain(start, end) {
 		return nil, errKeyEmpty
 	}
 	itr := db.db.NewIterator(db.ro)
@@ -207,7 +207,7 @@ func (db *RocksDB) Iterator(start, end []byte) (Iterator, error) {
 
 // ReverseIterator implements DB.
 func (db *RocksDB) ReverseIterator(start, end []byte) (Iterator, error) {
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+	if !isValidDomain(start, end) {
 		return nil, errKeyEmpty
 	}
 	itr := db.db.NewIterator(db.ro)
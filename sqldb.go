@@ -0,0 +1,261 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/spf13/cast"
+)
+
+func init() {
+	dbCreator := func(name string, dir string, opts Options) (DB, error) {
+		return newSQLBackendDb(name, dir, opts)
+	}
+	registerDBCreator(SQLBackend, dbCreator, false)
+}
+
+const (
+	defaultSQLTable  = "state_storage"
+	defaultSQLDriver = "sqlite3"
+)
+
+var sqlTableName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// sqlDialects holds the dialects of the drivers NewSQLDb knows about.
+var sqlDialects = map[string]Dialect{
+	"sqlite3":  sqliteDialect{},
+	"postgres": postgresDialect{},
+	"pgx":      postgresDialect{},
+}
+
+// Dialect adapts the statements of SQLDb to a database engine. Table names
+// passed to its methods are already quoted with QuoteIdentifier.
+type Dialect interface {
+	// Placeholder returns the placeholder of the n-th argument of a
+	// statement, counting from 1.
+	Placeholder(n int) string
+
+	// QuoteIdentifier quotes the name of a table for use in statements.
+	QuoteIdentifier(name string) string
+
+	// CreateTable returns the statement creating table, unless it exists, with
+	// binary key and value columns. Keys must be unique, and ordered bytewise
+	// like bytes.Compare.
+	CreateTable(table string) string
+
+	// Upsert returns the statement setting the value, given as the second
+	// argument, of the key given as the first argument in table.
+	Upsert(table string) string
+}
+
+// SQLDb is a DB on top of any database/sql driver. Keys and values are stored
+// in a table with binary columns, and the statements are adapted to the
+// database engine by a Dialect. SqliteDb remains the backend of choice for
+// SQLite, with the features specific to it.
+type SQLDb struct {
+	db      *sql.DB
+	dialect Dialect
+	// table is the quoted name of the table holding the entries.
+	table string
+}
+
+var _ DB = (*SQLDb)(nil)
+
+// NewSQLDb opens the database dsn with the database/sql driver driverName,
+// whose package must be imported, and creates the table if needed. Recognized
+// opts keys, which may be nil:
+//
+//	dialect  Dialect  statements of the database engine; required unless driverName is sqlite3, postgres or pgx
+//	table    string   name of the table holding the entries, default state_storage
+func NewSQLDb(driverName, dsn string, opts Options) (*SQLDb, error) {
+	dialect, table := sqlDialects[driverName], defaultSQLTable
+	if opts != nil {
+		switch d := opts.Get("dialect").(type) {
+		case nil:
+		case Dialect:
+			dialect = d
+		default:
+			return nil, fmt.Errorf("invalid dialect option of type %T", d)
+		}
+		if v := opts.Get("table"); v != nil {
+			table = cast.ToString(v)
+			if !sqlTableName.MatchString(table) {
+				return nil, fmt.Errorf("invalid table name %q", table)
+			}
+		}
+	}
+	if dialect == nil {
+		return nil, fmt.Errorf("missing dialect option for the %s driver", driverName)
+	}
+
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s DB: %w", driverName, err)
+	}
+	s := &SQLDb{
+		db:      db,
+		dialect: dialect,
+		table:   dialect.QuoteIdentifier(table),
+	}
+	if _, err := db.Exec(dialect.CreateTable(s.table)); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to exec SQL statement: %w", err)
+	}
+	return s, nil
+}
+
+// newSQLBackendDb opens the database of the SQLBackend, whose driver and dsn
+// options default to a sqlite3 database file named after name in dir.
+func newSQLBackendDb(name string, dir string, opts Options) (*SQLDb, error) {
+	driverName, dsn := defaultSQLDriver, ""
+	if opts != nil {
+		if v := opts.Get("driver"); v != nil {
+			driverName = cast.ToString(v)
+		}
+		dsn = cast.ToString(opts.Get("dsn"))
+	}
+	if dsn == "" {
+		if driverName != defaultSQLDriver {
+			return nil, fmt.Errorf("missing dsn option for the %s driver", driverName)
+		}
+		if dir != "" {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return nil, fmt.Errorf("failed to create DB directory '%s': %w", dir, err)
+			}
+		}
+		dsn = filepath.Join(dir, name+DBFileSuffix)
+	}
+	return NewSQLDb(driverName, dsn, opts)
+}
+
+// Get implements DB.
+func (s *SQLDb) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errKeyEmpty
+	}
+
+	var value []byte
+	stmt := fmt.Sprintf(`SELECT value FROM %s WHERE key = %s;`, s.table, s.dialect.Placeholder(1))
+	if err := s.db.QueryRow(stmt, key).Scan(&value); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query row: %w", err)
+	}
+	if value == nil {
+		// An empty value is still a value.
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// Has implements DB.
+func (s *SQLDb) Has(key []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, errKeyEmpty
+	}
+
+	var exists bool
+	stmt := fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE key = %s);`, s.table, s.dialect.Placeholder(1))
+	if err := s.db.QueryRow(stmt, key).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to query row: %w", err)
+	}
+	return exists, nil
+}
+
+// Set implements DB.
+func (s *SQLDb) Set(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if value == nil {
+		return errValueNil
+	}
+	if _, err := s.db.Exec(s.dialect.Upsert(s.table), key, value); err != nil {
+		return fmt.Errorf("failed to exec SQL set statement: %w", err)
+	}
+	return nil
+}
+
+// SetSync implements DB. Committed writes are as durable as the database
+// engine makes them, so it is the same as Set.
+func (s *SQLDb) SetSync(key []byte, value []byte) error {
+	return s.Set(key, value)
+}
+
+// Delete implements DB.
+func (s *SQLDb) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if _, err := s.db.Exec(s.delStmt(), key); err != nil {
+		return fmt.Errorf("failed to exec SQL delete statement: %w", err)
+	}
+	return nil
+}
+
+// DeleteSync implements DB; see SetSync.
+func (s *SQLDb) DeleteSync(key []byte) error {
+	return s.Delete(key)
+}
+
+// delStmt returns the statement deleting the key given as its argument.
+func (s *SQLDb) delStmt() string {
+	return fmt.Sprintf(`DELETE FROM %s WHERE key = %s;`, s.table, s.dialect.Placeholder(1))
+}
+
+// Iterator implements DB.
+func (s *SQLDb) Iterator(start, end []byte) (Iterator, error) {
+	if !isValidDomain(start, end) {
+		return nil, errKeyEmpty
+	}
+	return newSQLIterator(s, start, end, false)
+}
+
+// ReverseIterator implements DB.
+func (s *SQLDb) ReverseIterator(start, end []byte) (Iterator, error) {
+	if !isValidDomain(start, end) {
+		return nil, errKeyEmpty
+	}
+	return newSQLIterator(s, start, end, true)
+}
+
+// Close implements DB.
+func (s *SQLDb) Close() error {
+	return s.db.Close()
+}
+
+// NewBatch implements DB.
+func (s *SQLDb) NewBatch() Batch {
+	return newSQLBatch(s)
+}
+
+// NewBatchWithSize implements DB.
+func (s *SQLDb) NewBatchWithSize(size int) Batch {
+	return s.NewBatch()
+}
+
+// Print implements DB.
+func (s *SQLDb) Print() error {
+	itr, err := s.Iterator(nil, nil)
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	for ; itr.Valid(); itr.Next() {
+		key := itr.Key()
+		value := itr.Value()
+		fmt.Printf("[%X]:\t[%X]\n", key, value)
+	}
+	return nil
+}
+
+// Stats implements DB. It reports the connection pool statistics listed by
+// sqlDBStats.
+func (s *SQLDb) Stats() map[string]string {
+	return sqlDBStats(s.db.Stats())
+}
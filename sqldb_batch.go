@@ -0,0 +1,105 @@
+package db
+
+import (
+	"fmt"
+)
+
+var _ Batch = (*sqlBatch)(nil)
+
+// sqlBatch buffers operations in memory and applies them in a single
+// transaction on Write.
+type sqlBatch struct {
+	db     *SQLDb
+	ops    []sqlBatchOp
+	size   int
+	closed bool
+}
+
+func newSQLBatch(db *SQLDb) *sqlBatch {
+	return &sqlBatch{
+		db:  db,
+		ops: make([]sqlBatchOp, 0),
+	}
+}
+
+// Set implements Batch.
+func (b *sqlBatch) Set(key, value []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if value == nil {
+		return errValueNil
+	}
+	if b.closed {
+		return errBatchClosed
+	}
+	b.size += len(key) + len(value)
+	b.ops = append(b.ops, sqlBatchOp{action: batchActionSet, key: key, value: value})
+	return nil
+}
+
+// Delete implements Batch.
+func (b *sqlBatch) Delete(key []byte) error {
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if b.closed {
+		return errBatchClosed
+	}
+	b.size += len(key)
+	b.ops = append(b.ops, sqlBatchOp{action: batchActionDel, key: key})
+	return nil
+}
+
+// Write implements Batch.
+func (b *sqlBatch) Write() error {
+	if b.closed {
+		return errBatchClosed
+	}
+
+	tx, err := b.db.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to create SQL transaction: %w", err)
+	}
+	upsert, del := b.db.dialect.Upsert(b.db.table), b.db.delStmt()
+	for _, op := range b.ops {
+		switch op.action {
+		case batchActionSet:
+			_, err = tx.Exec(upsert, op.key, op.value)
+		case batchActionDel:
+			_, err = tx.Exec(del, op.key)
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			return fmt.Errorf("failed to exec batch SQL statement: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to write SQL transaction: %w", err)
+	}
+	b.closed = true
+
+	return nil
+}
+
+// WriteSync implements Batch.
+func (b *sqlBatch) WriteSync() error {
+	if err := b.Write(); err != nil {
+		return err
+	}
+	return b.Close()
+}
+
+// Close implements Batch.
+func (b *sqlBatch) Close() error {
+	b.closed = true
+	return nil
+}
+
+// GetByteSize implements Batch.
+func (b *sqlBatch) GetByteSize() (int, error) {
+	if b.closed {
+		return 0, errBatchClosed
+	}
+	return b.size, nil
+}
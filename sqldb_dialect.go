@@ -0,0 +1,84 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	_ Dialect = sqliteDialect{}
+	_ Dialect = postgresDialect{}
+)
+
+// sqliteDialect is the Dialect of SQLite. Its table has the schema of the
+// table of SqliteDb, so that either can open a file written by the other.
+type sqliteDialect struct{}
+
+// Placeholder implements Dialect.
+func (sqliteDialect) Placeholder(int) string {
+	return "?"
+}
+
+// QuoteIdentifier implements Dialect.
+func (sqliteDialect) QuoteIdentifier(name string) string {
+	return quoteSQLIdentifier(name)
+}
+
+// CreateTable implements Dialect. BLOB columns compare with memcmp.
+func (sqliteDialect) CreateTable(table string) string {
+	return fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		id integer not null primary key,
+		key BLOB not null,
+		value BLOB not null,
+		unique (key)
+	);
+	`, table)
+}
+
+// Upsert implements Dialect.
+func (sqliteDialect) Upsert(table string) string {
+	return fmt.Sprintf(`
+	INSERT INTO %s(key, value)
+	VALUES(?, ?)
+	ON CONFLICT(key) DO UPDATE SET value = excluded.value;
+	`, table)
+}
+
+// postgresDialect is the Dialect of PostgreSQL. bytea columns compare
+// bytewise.
+type postgresDialect struct{}
+
+// Placeholder implements Dialect.
+func (postgresDialect) Placeholder(n int) string {
+	return fmt.Sprintf("$%d", n)
+}
+
+// QuoteIdentifier implements Dialect.
+func (postgresDialect) QuoteIdentifier(name string) string {
+	return quoteSQLIdentifier(name)
+}
+
+// CreateTable implements Dialect.
+func (postgresDialect) CreateTable(table string) string {
+	return fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %s (
+		key bytea not null primary key,
+		value bytea not null
+	);
+	`, table)
+}
+
+// Upsert implements Dialect.
+func (postgresDialect) Upsert(table string) string {
+	return fmt.Sprintf(`
+	INSERT INTO %s(key, value)
+	VALUES($1, $2)
+	ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value;
+	`, table)
+}
+
+// quoteSQLIdentifier quotes name with double quotes, as in standard SQL.
+func quoteSQLIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var _ Iterator = (*sqlIterator)(nil)
+
+type sqlIterator struct {
+	rows       *sql.Rows
+	key, val   []byte
+	start, end []byte
+	valid      bool
+	err        error
+}
+
+// newSQLIterator starts a scan over [start, end) in ascending, or if reverse
+// is set, descending key order.
+func newSQLIterator(db *SQLDb, start, end []byte, reverse bool) (*sqlIterator, error) {
+	var (
+		keyClause = []string{}
+		queryArgs = []any{}
+	)
+	if start != nil {
+		queryArgs = append(queryArgs, start)
+		keyClause = append(keyClause, "key >= "+db.dialect.Placeholder(len(queryArgs)))
+	}
+	if end != nil {
+		queryArgs = append(queryArgs, end)
+		keyClause = append(keyClause, "key < "+db.dialect.Placeholder(len(queryArgs)))
+	}
+	whereClause := "1=1"
+	if len(keyClause) > 0 {
+		whereClause = strings.Join(keyClause, " AND ")
+	}
+	orderBy := "ASC"
+	if reverse {
+		orderBy = "DESC"
+	}
+
+	rows, err := db.db.Query(fmt.Sprintf(`
+	SELECT key, value FROM %s
+	WHERE %s ORDER BY key %s;
+	`, db.table, whereClause, orderBy), queryArgs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute iterator SQL query: %w", err)
+	}
+
+	itr := &sqlIterator{
+		rows:  rows,
+		start: start,
+		end:   end,
+	}
+	itr.next()
+	return itr, nil
+}
+
+// Domain implements Iterator.
+func (itr *sqlIterator) Domain() ([]byte, []byte) {
+	return itr.start, itr.end
+}
+
+// Valid implements Iterator.
+func (itr *sqlIterator) Valid() bool {
+	return itr.valid
+}
+
+// Next implements Iterator.
+func (itr *sqlIterator) Next() {
+	itr.assertIsValid()
+	itr.next()
+}
+
+// next reads the next row, if any.
+func (itr *sqlIterator) next() {
+	itr.valid = false
+	if itr.rows == nil || !itr.rows.Next() {
+		return
+	}
+	var key, value []byte
+	if err := itr.rows.Scan(&key, &value); err != nil {
+		itr.err = fmt.Errorf("failed to scan row: %w", err)
+		return
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	itr.key, itr.val = key, value
+	itr.valid = true
+}
+
+// Key implements Iterator.
+func (itr *sqlIterator) Key() []byte {
+	itr.assertIsValid()
+	return slices.Clone(itr.key)
+}
+
+// Value implements Iterator.
+func (itr *sqlIterator) Value() []byte {
+	itr.assertIsValid()
+	return slices.Clone(itr.val)
+}
+
+// Error implements Iterator.
+func (itr *sqlIterator) Error() error {
+	if itr.err != nil {
+		return itr.err
+	}
+	if itr.rows == nil {
+		return nil
+	}
+	return itr.rows.Err()
+}
+
+// Close implements Iterator.
+func (itr *sqlIterator) Close() error {
+	itr.valid = false
+	if itr.rows == nil {
+		return nil
+	}
+	err := itr.rows.Close()
+	itr.rows = nil
+	return err
+}
+
+func (itr *sqlIterator) assertIsValid() {
+	if !itr.valid {
+		panic("iterator is invalid")
+	}
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLDbOptions(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "testdb"+DBFileSuffix)
+	for _, opts := range []OptionsMap{
+		{"table": "state; DROP"},
+		{"dialect": "sqlite"},
+	} {
+		_, err := NewSQLDb("sqlite3", dsn, opts)
+		require.Error(t, err, opts)
+	}
+	_, err := NewSQLDb("mysql", "user@/db", nil)
+	require.ErrorContains(t, err, "missing dialect")
+	_, err = NewDBwithOptions("testdb", SQLBackend, t.TempDir(), OptionsMap{"driver": "postgres"})
+	require.ErrorContains(t, err, "missing dsn")
+
+	// A dialect given as an option applies to any driver name.
+	db, err := NewSQLDb("sqlite3", dsn, OptionsMap{"dialect": sqliteDialect{}, "table": "other"})
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, `"other"`, db.table)
+	require.NoError(t, db.Set([]byte("a"), []byte{1}))
+	has, err := db.Has([]byte("a"))
+	require.NoError(t, err)
+	require.True(t, has)
+}
+
+func TestSQLDbSqliteInterop(t *testing.T) {
+	dir := t.TempDir()
+	sqlite, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer sqlite.Close()
+	require.NoError(t, sqlite.Set([]byte("a"), []byte{1}))
+
+	// The generic backend opens the file written by SqliteDb, and the other
+	// way around.
+	db, err := NewSQLDb("sqlite3", filepath.Join(dir, "testdb"+DBFileSuffix), nil)
+	require.NoError(t, err)
+	defer db.Close()
+	checkValue(t, db, []byte("a"), []byte{1})
+	require.NoError(t, db.Set([]byte("b"), []byte{}))
+	require.NoError(t, db.Set([]byte("a"), []byte{2}))
+	assertKeyValues(t, sqlite, map[string][]byte{"a": {2}, "b": {}})
+}
+
+func TestSQLDialectPlaceholders(t *testing.T) {
+	require.Equal(t, "?", sqliteDialect{}.Placeholder(2))
+	require.Equal(t, "$2", postgresDialect{}.Placeholder(2))
+	require.Equal(t, `"state ""storage"""`, postgresDialect{}.QuoteIdentifier(`state "storage"`))
+}
@@ -1,13 +1,20 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 func init() {
@@ -19,167 +26,765 @@ func init() {
 
 type SqliteDb struct {
 	db *sql.DB
+	// reads is the pool that reads run on: db, or with separate_read_write a
+	// pool of read-only connections, so that db only serves writes.
+	reads *sql.DB
+	opts  sqliteOptions
+	// table holds the statements on the table of the store's namespace.
+	table sqliteTable
+	// path is the database file, empty for an in-memory database.
+	path string
+	// getStmt and hasStmt are the point lookups of Get and Has. They are
+	// prepared once, *sql.Stmt being safe for concurrent use.
+	getStmt *sql.Stmt
+	hasStmt *sql.Stmt
+	// ac is set in auto-commit mode.
+	ac *sqliteAutoCommit
+	// storeID identifies this store in a shared ReadCache.
+	storeID uint64
+
+	// iterators and snapshots hold the open iterators and snapshots, each of
+	// which holds a connection.
+	itrMtx    sync.Mutex
+	iterators map[*sqliteIterator]struct{}
+	snapshots map[*sqliteSnapshot]struct{}
+
+	// root is the store that opened the database file, if this is a store
+	// returned by Namespace. Otherwise namespaces holds the open namespace
+	// stores and nsStoreIDs the ReadCache identifier of each namespace.
+	root       *SqliteDb
+	nsMtx      sync.Mutex
+	namespaces map[*SqliteDb]struct{}
+	nsStoreIDs map[string]uint64
+
+	// poolMtx serializes exclusive sections, which temporarily replace the
+	// pool limits below; database/sql offers no way to read them back.
+	poolMtx      sync.Mutex
+	maxOpenConns int
+	maxIdleConns int
+
+	// count is the result of the latest Count, taken at countAt, which Stats
+	// reports rather than counting every time.
+	countMtx sync.Mutex
+	count    int64
+	countAt  time.Time
+}
+
+// sqliteQuerier is implemented by both *sql.DB and *sql.Tx.
+type sqliteQuerier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
 }
 
 var _ DB = (*SqliteDb)(nil)
 
-const (
-	driverName = "sqlite3"
-	// dbName     = "ss.db?cache=shared&mode=rwc&_journal_mode=WAL"
-
-	reservedUpsertStmt = `
-	INSERT INTO state_storage(key, value)
-    VALUES(?, ?)
-  ON CONFLICT(key) DO UPDATE SET
-    value = ?;
-	`
-	upsertStmt = `
-	INSERT INTO state_storage(key, value)
-    VALUES(?, ?)
-  ON CONFLICT(key) DO UPDATE SET
-    value = ?;
-	`
-	delStmt = `DELETE FROM state_storage WHERE key = ?;`
+var (
+	errIteratorsOpen = errors.New("iterators are still open")
+	errSnapshotsOpen = errors.New("snapshots are still open")
+
+	// errReadOnly is returned by writes to a store opened with read_only.
+	errReadOnly = errors.New("database is read-only")
 )
 
 func NewSqliteDb(name string, dir string, opts Options) (*SqliteDb, error) {
 	return NewSqliteDbWithOpts(name, dir, opts)
 }
 
+// NewSqliteDbWithOpts opens, and creates if needed, the database name in dir.
+// See parseSqliteOptions for the recognized opts.
+//
+// A database created by an older version, whose tables use an outdated schema,
+// is only opened with the migrate_schema option, which migrates it first.
+//
+// With the in_memory option, the database lives on a single connection that is
+// shared by every call: an open iterator holds it, so close iterators before
+// using the store otherwise.
 func NewSqliteDbWithOpts(name string, dir string, opts Options) (*SqliteDb, error) {
-	dbPath := filepath.Join(dir, name+DBFileSuffix)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return nil, fmt.Errorf("failed to create DB directory '%s': %w", dir, err)
+	sopts, err := parseSqliteOptions(opts)
+	if err != nil {
+		return nil, err
 	}
 
-	db, err := sql.Open(driverName, dbPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open sqlite DB '%s': %w", dbPath, err)
+	storeID := sqliteStoreIDs.Add(1)
+	path := filepath.Join(dir, name+DBFileSuffix)
+	dbPath := path
+	if sopts.inMemory {
+		path = ""
+		// Name the database after the store so that in-memory stores opened
+		// in the same process never share their data.
+		dbPath = fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", url.PathEscape(name), storeID)
+	} else if sopts.readOnly {
+		dbPath = sqliteReadOnlyDSN(path)
+	} else if dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create DB directory '%s': %w", dir, err)
+		}
+	}
+
+	db := sql.OpenDB(&sqliteConnector{
+		driver:  &sqlite3.SQLiteDriver{},
+		dsn:     dbPath,
+		pragmas: sopts.pragmas(),
+		key:     sopts.encryptionKey,
+	})
+	maxOpenConns, maxIdleConns := sopts.maxOpenConns, sopts.maxIdleConns
+	if sopts.separateReadWrite {
+		// SQLite runs one write transaction at a time: queue writes for the
+		// single writer connection rather than have them fail as busy.
+		maxOpenConns, maxIdleConns = 1, 1
 	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxLifetime(sopts.connMaxLifetime)
 
-	stmt := `
-	CREATE TABLE IF NOT EXISTS state_storage (
-		id integer not null primary key,
-		key varchar not null,
-		value varchar not null,
-		unique (key)
-	);
+	if sopts.readOnly {
+		err = checkSqliteSchema(db)
+	} else {
+		err = migrateSqliteSchema(db, sopts.migrateSchema)
+	}
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
 
-	CREATE UNIQUE INDEX IF NOT EXISTS idx_key ON state_storage (key);
-	`
-	// stmt := `
-	// CREATE TABLE IF NOT EXISTS state_storage (
-	// 	id integer not null primary key,
-	// 	key BLOB,
-	// 	value    BLOB,
-	// );
+	reads := db
+	if sopts.separateReadWrite {
+		// The read connections are only opened once the table exists, which
+		// they cannot create.
+		readOpts := sopts
+		readOpts.readOnly = true
+		reads = sql.OpenDB(&sqliteConnector{
+			driver:  &sqlite3.SQLiteDriver{},
+			dsn:     sqliteReadOnlyDSN(path),
+			pragmas: readOpts.pragmas(),
+			key:     sopts.encryptionKey,
+		})
+		reads.SetMaxOpenConns(sopts.maxOpenConns)
+		reads.SetMaxIdleConns(sopts.maxIdleConns)
+		reads.SetConnMaxLifetime(sopts.connMaxLifetime)
+	}
 
-	// CREATE UNIQUE INDEX IF NOT EXISTS idx_key ON state_storage (key);
-	// `
-	_, err = db.Exec(stmt)
+	table := newSqliteTable(sqliteDefaultNamespace)
+	get, has, err := table.open(db, reads, !sopts.readOnly)
 	if err != nil {
-		return nil, fmt.Errorf("failed to exec SQL statement: %w", err)
+		if reads != db {
+			_ = reads.Close()
+		}
+		_ = db.Close()
+		return nil, err
 	}
-	_, err = db.Exec(`PRAGMA journal_mode = WAL;`)
+
+	s := &SqliteDb{
+		db:           db,
+		reads:        reads,
+		opts:         sopts,
+		table:        table,
+		path:         path,
+		getStmt:      get,
+		hasStmt:      has,
+		storeID:      storeID,
+		iterators:    make(map[*sqliteIterator]struct{}),
+		snapshots:    make(map[*sqliteSnapshot]struct{}),
+		namespaces:   make(map[*SqliteDb]struct{}),
+		nsStoreIDs:   map[string]uint64{sqliteDefaultNamespace: storeID},
+		maxOpenConns: maxOpenConns,
+		maxIdleConns: maxIdleConns,
+	}
+	if !s.opts.readOnly && (s.opts.autoCommitInterval > 0 || s.opts.autoCommitOps > 0) {
+		s.ac = newSqliteAutoCommit(db, s.opts.autoCommitInterval, s.opts.autoCommitOps, s.opts.observer)
+	}
+
+	return s, nil
+}
+
+// sqliteReadOnlyDSN returns the DSN opening the database file path read-only.
+// immutable=1 is not set: it is only safe if nothing writes to the file, while
+// read-only connections are meant to read live databases.
+func sqliteReadOnlyDSN(path string) string {
+	return fmt.Sprintf("file:%s?mode=ro", (&url.URL{Path: path}).EscapedPath())
+}
+
+// sqliteConnector opens connections to a SQLite database and runs the
+// configured PRAGMAs on each of them right away: most PRAGMAs, such as
+// busy_timeout and synchronous, only apply to the connection that runs them.
+type sqliteConnector struct {
+	driver  *sqlite3.SQLiteDriver
+	dsn     string
+	pragmas []string
+	// key, if set, is the SQLCipher encryption key, applied before the
+	// PRAGMAs.
+	key string
+}
+
+var _ driver.Connector = (*sqliteConnector)(nil)
+
+// Connect implements driver.Connector.
+func (c *sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to exec SQL statement: %w", err)
+		return nil, fmt.Errorf("failed to open sqlite DB '%s': %w", c.dsn, err)
+	}
+	if c.key != "" {
+		if err := c.applyKey(conn.(*sqlite3.SQLiteConn)); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
 	}
+	for _, pragma := range c.pragmas {
+		if _, err := conn.(*sqlite3.SQLiteConn).Exec(pragma, nil); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("failed to exec %q: %w", pragma, wrapSqliteNotADB(err))
+		}
+	}
+	return conn, nil
+}
 
-	return &SqliteDb{db: db}, nil
+// Driver implements driver.Connector.
+func (c *sqliteConnector) Driver() driver.Driver {
+	return c.driver
 }
 
+// Close implements DB. Iterators and snapshots that are still open are closed
+// first, as each of them holds a connection, which would otherwise keep
+// the database busy and prevent WAL checkpoints. Closing a store returned by
+// Namespace leaves the database open; closing the store that opened it closes
+// its namespace stores too.
 func (s *SqliteDb) Close() error {
+	if s.root != nil {
+		return s.closeNamespace()
+	}
+
+	s.nsMtx.Lock()
+	namespaces := make([]*SqliteDb, 0, len(s.namespaces))
+	for ns := range s.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	s.nsMtx.Unlock()
 	var err error
+	for _, ns := range namespaces {
+		if cerr := ns.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := s.closeReaders(); err == nil {
+		err = cerr
+	}
+	if s.ac != nil {
+		if cerr := s.ac.close(); err == nil {
+			err = cerr
+		}
+		s.ac = nil
+	}
+	if s.opts.readCache != nil {
+		for _, storeID := range s.nsStoreIDs {
+			s.opts.readCache.dropStore(storeID)
+		}
+	}
+	if cerr := s.closeStmts(); err == nil {
+		err = cerr
+	}
+	if s.reads != nil && s.reads != s.db {
+		if cerr := s.reads.Close(); err == nil {
+			err = cerr
+		}
+	}
 	if s.db != nil {
-		err = s.db.Close()
+		if cerr := s.db.Close(); err == nil {
+			err = cerr
+		}
+	}
+	s.db, s.reads = nil, nil
+	return err
+}
+
+// closeNamespace releases the iterators, snapshots and statements of a store
+// returned by Namespace.
+func (s *SqliteDb) closeNamespace() error {
+	err := s.closeReaders()
+	if cerr := s.closeStmts(); err == nil {
+		err = cerr
+	}
+	s.root.nsMtx.Lock()
+	delete(s.root.namespaces, s)
+	s.root.nsMtx.Unlock()
+	s.db, s.reads, s.ac = nil, nil, nil
+	return err
+}
+
+// closeReaders closes the open iterators and snapshots.
+func (s *SqliteDb) closeReaders() error {
+	s.itrMtx.Lock()
+	iterators := make([]*sqliteIterator, 0, len(s.iterators))
+	for itr := range s.iterators {
+		iterators = append(iterators, itr)
+	}
+	snapshots := make([]*sqliteSnapshot, 0, len(s.snapshots))
+	for snap := range s.snapshots {
+		snapshots = append(snapshots, snap)
+	}
+	s.itrMtx.Unlock()
+	var err error
+	for _, itr := range iterators {
+		if cerr := itr.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for _, snap := range snapshots {
+		if cerr := snap.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *SqliteDb) closeStmts() error {
+	var err error
+	for _, stmt := range []*sql.Stmt{s.getStmt, s.hasStmt} {
+		if stmt == nil {
+			continue
+		}
+		if cerr := stmt.Close(); err == nil {
+			err = cerr
+		}
 	}
-	s.db = nil
+	s.getStmt, s.hasStmt = nil, nil
 	return err
 }
-func (s *SqliteDb) Delete(key []byte) error {
+
+// Flush commits the writes buffered in auto-commit mode. It is a no-op
+// otherwise.
+func (s *SqliteDb) Flush() error {
+	if s.ac == nil {
+		return nil
+	}
+	return s.ac.flush()
+}
+
+// flushed commits the buffered auto-commit writes, like Flush, and runs fn
+// before the next auto-commit transaction can begin, so that the writes of fn
+// do not fail with "database is locked" because of it.
+func (s *SqliteDb) flushed(fn func() error) error {
+	if s.ac == nil {
+		return fn()
+	}
+	return s.ac.exclusive(fn)
+}
+
+func (s *SqliteDb) Delete(key []byte) (err error) {
+	if s.opts.observer != nil {
+		defer func(begin time.Time) { s.opts.observer("delete", time.Since(begin), len(key), 0, err) }(time.Now())
+	}
+	if s.opts.readOnly {
+		return errReadOnly
+	}
 	if len(key) == 0 {
 		return errKeyEmpty
 	}
-	_, err := s.db.Exec(delStmt, key)
+	defer s.invalidate(key)
+	if s.ac != nil {
+		return s.ac.delete(s.table, key)
+	}
+	err = s.opts.retryBusy(context.Background(), func() error {
+		_, err := s.db.Exec(s.table.del, key)
+		return err
+	})
 	if err != nil {
 		return fmt.Errorf("failed to prepare SQL delete statement: %w", err)
 	}
 	return err
 }
 
+// invalidate drops keys from the read cache, if there is one.
+func (s *SqliteDb) invalidate(keys ...[]byte) {
+	if s.opts.readCache != nil {
+		s.opts.readCache.invalidate(s.storeID, keys...)
+	}
+}
+
 // Get([]byte) ([]byte, error)
 func (s *SqliteDb) Get(key []byte) ([]byte, error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext is like Get, but the query is aborted once ctx is done.
+func (s *SqliteDb) GetContext(ctx context.Context, key []byte) (value []byte, err error) {
+	if s.opts.observer != nil {
+		defer func(begin time.Time) { s.opts.observer("get", time.Since(begin), len(key), len(value), err) }(time.Now())
+	}
 	if len(key) == 0 {
 		return nil, errKeyEmpty
 	}
-	stmt, err := s.db.Prepare(`
-	SELECT value FROM state_storage
-	WHERE key = ?
-	LIMIT 1;
-	`)
-	if err != nil {
-		return nil, fmt.Errorf("failed to prepare SQL statement: %w", err)
+
+	if s.ac != nil {
+		if w, ok := s.ac.lookup(s.table, key); ok {
+			if w.value == nil {
+				return nil, nil
+			}
+			return cp(w.value), nil
+		}
 	}
 
-	defer stmt.Close()
+	var epoch uint64
+	if s.opts.readCache != nil {
+		value, e, ok := s.opts.readCache.get(s.storeID, key)
+		if ok {
+			return value, nil
+		}
+		epoch = e
+	}
 
-	var (
-		value []byte
-	)
-	if err := stmt.QueryRow(key).Scan(&value); err != nil {
+	// Writes that are not committed yet were served from the buffer above, so
+	// the read does not need to wait for the auto-commit transaction: it runs
+	// on another connection, as auto-commit mode requires more than one.
+	err = s.readCommitted(func(q sqliteQuerier) error {
+		return s.queryGet(ctx, q, key).Scan(&value)
+	})
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
 		}
 
 		return nil, fmt.Errorf("failed to query row: %w", err)
 	}
+	if s.opts.decodeValue != nil {
+		decoded, upgrade, err := s.opts.decodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode value: %w", err)
+		}
+		if upgrade && s.opts.encodeValue != nil && !s.opts.readOnly {
+			// Rewriting the entry in the current format is best effort: the read
+			// itself succeeded, and the entry is upgraded again on the next read.
+			_ = s.upgrade(ctx, key, decoded, value)
+		}
+		value = decoded
+	}
+	if value == nil {
+		// The key exists, with an empty value.
+		value = []byte{}
+	}
+	if s.opts.readCache != nil {
+		s.opts.readCache.put(s.storeID, key, value, epoch)
+	}
 	return value, nil
 }
 
-// Has(key []byte) (bool, error)
+// upgrade rewrites key, whose value was read as previous, in the current
+// format of value. The rewrite only applies if the key still holds previous,
+// so that it never overwrites a write made since the read.
+func (s *SqliteDb) upgrade(ctx context.Context, key, value, previous []byte) error {
+	stored, err := s.encode(value)
+	if err != nil {
+		return err
+	}
+	if s.ac != nil {
+		return s.ac.upgrade(s.table, key, value, stored, previous)
+	}
+	return s.opts.retryBusy(ctx, func() error {
+		_, err := s.db.ExecContext(ctx, s.table.upgrade, stored, key, previous)
+		return err
+	})
+}
+
+// queryGet runs the cached point lookup for key on q.
+func (s *SqliteDb) queryGet(ctx context.Context, q sqliteQuerier, key []byte) *sql.Row {
+	return s.queryStmt(ctx, q, s.getStmt, s.table.get, key)
+}
+
+// queryStmt runs the prepared statement stmt, whose text is query, on q.
+func (s *SqliteDb) queryStmt(ctx context.Context, q sqliteQuerier, stmt *sql.Stmt, query string, key []byte) *sql.Row {
+	switch q := q.(type) {
+	case *sql.DB:
+		return stmt.QueryRowContext(ctx, key)
+	case *sql.Tx:
+		// The transaction-specific statement is closed with the transaction.
+		return q.StmtContext(ctx, stmt).QueryRowContext(ctx, key)
+	default:
+		return q.QueryRow(query, key)
+	}
+}
+
+// read runs fn so that it observes every write made through this handle. In
+// auto-commit mode fn runs in the open write transaction, if there is one, so
+// that reads observe the writes buffered in it; otherwise see readCommitted.
+func (s *SqliteDb) read(fn func(q sqliteQuerier) error) error {
+	if s.ac != nil {
+		if ok, err := s.ac.read(fn); ok {
+			return err
+		}
+	}
+	return s.readCommitted(fn)
+}
+
+// readCommitted runs fn against the read pool, outside of any transaction.
+// Under WAL each statement run outside a transaction starts a read of its own,
+// from the latest snapshot, so it observes every transaction committed before
+// it on any pooled connection, such as a batch written just before.
+func (s *SqliteDb) readCommitted(fn func(q sqliteQuerier) error) error {
+	return fn(s.reads)
+}
+
+// Has implements DB. It checks that a row exists for key, whatever the length
+// of its value, without reading the value.
 func (s *SqliteDb) Has(key []byte) (bool, error) {
-	value, err := s.Get(key)
+	if len(key) == 0 {
+		return false, errKeyEmpty
+	}
+	if s.ac != nil {
+		if w, ok := s.ac.lookup(s.table, key); ok {
+			return w.value != nil, nil
+		}
+	}
+
+	var exists bool
+	ctx := context.Background()
+	err := s.readCommitted(func(q sqliteQuerier) error {
+		return s.queryStmt(ctx, q, s.hasStmt, s.table.has, key).Scan(&exists)
+	})
 	if err != nil {
-		return false, err
+		return false, fmt.Errorf("failed to query row: %w", err)
 	}
-	return value != nil, nil
+	return exists, nil
 }
 func (s *SqliteDb) Set(key []byte, value []byte) error {
+	return s.SetContext(context.Background(), key, value)
+}
+
+// SetContext is like Set, but the write is aborted once ctx is done. In
+// auto-commit mode the write only joins the open transaction, so ctx is merely
+// checked before it is buffered.
+func (s *SqliteDb) SetContext(ctx context.Context, key []byte, value []byte) (err error) {
+	if s.opts.observer != nil {
+		defer func(begin time.Time) { s.opts.observer("set", time.Since(begin), len(key), len(value), err) }(time.Now())
+	}
+	if s.opts.readOnly {
+		return errReadOnly
+	}
 	if len(key) == 0 {
 		return errKeyEmpty
 	}
 	if value == nil {
 		return errValueNil
 	}
-	_, err := s.db.Exec(upsertStmt, key, value, value)
+	stored, err := s.encode(value)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer s.invalidate(key)
+	if s.ac != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return s.ac.set(s.table, key, value, stored)
+	}
+	return s.opts.retryBusy(ctx, func() error {
+		_, err := s.db.ExecContext(ctx, s.table.upsert, key, stored, stored)
+		return err
+	})
 }
 
-func (s *SqliteDb) SetSync(key []byte, value []byte) error {
-	return s.Set(key, value)
+// encode returns the stored representation of value.
+func (s *SqliteDb) encode(value []byte) ([]byte, error) {
+	if s.opts.encodeValue == nil {
+		return value, nil
+	}
+	encoded, err := s.opts.encodeValue(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode value: %w", err)
+	}
+	return encoded, nil
 }
 
-func (s *SqliteDb) DeleteSync(key []byte) error {
-	return s.Delete(key)
+// SetSync implements DB. Unlike Set, the write is synced to disk before
+// SetSync returns, at the cost of an fsync; see durable. In auto-commit mode
+// the buffered writes are committed first, and are made durable along with it.
+func (s *SqliteDb) SetSync(key []byte, value []byte) (err error) {
+	if s.opts.observer != nil {
+		defer func(begin time.Time) { s.opts.observer("set", time.Since(begin), len(key), len(value), err) }(time.Now())
+	}
+	if s.opts.readOnly {
+		return errReadOnly
+	}
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	if value == nil {
+		return errValueNil
+	}
+	stored, err := s.encode(value)
+	if err != nil {
+		return err
+	}
+	defer s.invalidate(key)
+	ctx := context.Background()
+	err = s.flushed(func() error {
+		return s.durable(ctx, func(q sqliteTxExecer) error {
+			_, err := q.ExecContext(ctx, s.table.upsert, key, stored, stored)
+			return err
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to exec SQL set statement: %w", err)
+	}
+	return nil
 }
 
-func (s *SqliteDb) Iterator(start, end []byte) (Iterator, error) {
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
-		return nil, errKeyEmpty
+// DeleteSync implements DB. Unlike Delete, the delete is synced to disk before
+// DeleteSync returns; see SetSync.
+func (s *SqliteDb) DeleteSync(key []byte) (err error) {
+	if s.opts.observer != nil {
+		defer func(begin time.Time) { s.opts.observer("delete", time.Since(begin), len(key), 0, err) }(time.Now())
+	}
+	if s.opts.readOnly {
+		return errReadOnly
+	}
+	if len(key) == 0 {
+		return errKeyEmpty
+	}
+	defer s.invalidate(key)
+	ctx := context.Background()
+	err = s.flushed(func() error {
+		return s.durable(ctx, func(q sqliteTxExecer) error {
+			_, err := q.ExecContext(ctx, s.table.del, key)
+			return err
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to exec SQL delete statement: %w", err)
 	}
+	return nil
+}
 
-	return newSqliteIterator(s, start, end, false)
+// Iterator implements DB. In auto-commit mode the buffered writes are
+// committed first so that the iterator observes them.
+func (s *SqliteDb) Iterator(start, end []byte) (Iterator, error) {
+	return s.newIterator(context.Background(), nil, start, end, false, 0)
 }
 
+// ReverseIterator implements DB. In auto-commit mode the buffered writes are
+// committed first so that the iterator observes them.
 func (s *SqliteDb) ReverseIterator(start, end []byte) (Iterator, error) {
-	if (start != nil && len(start) == 0) || (end != nil && len(end) == 0) {
+	return s.newIterator(context.Background(), nil, start, end, true, 0)
+}
+
+// IteratorContext is like Iterator, but the scan is aborted once ctx is done:
+// the iterator then becomes invalid and its Error reports ctx.Err().
+func (s *SqliteDb) IteratorContext(ctx context.Context, start, end []byte) (Iterator, error) {
+	return s.newIterator(ctx, nil, start, end, false, 0)
+}
+
+// ReverseIteratorContext is like ReverseIterator, but the scan is aborted once
+// ctx is done; see IteratorContext.
+func (s *SqliteDb) ReverseIteratorContext(ctx context.Context, start, end []byte) (Iterator, error) {
+	return s.newIterator(ctx, nil, start, end, true, 0)
+}
+
+// IteratorWithTimeout is like Iterator, but the scan is aborted once timeout
+// elapses, independently of any other scan. An aborted iterator becomes
+// invalid and its Error reports context.DeadlineExceeded.
+func (s *SqliteDb) IteratorWithTimeout(start, end []byte, timeout time.Duration) (Iterator, error) {
+	return s.iteratorWithTimeout(start, end, timeout, false)
+}
+
+// ReverseIteratorWithTimeout is like ReverseIterator, but the scan is aborted
+// once timeout elapses; see IteratorWithTimeout.
+func (s *SqliteDb) ReverseIteratorWithTimeout(start, end []byte, timeout time.Duration) (Iterator, error) {
+	return s.iteratorWithTimeout(start, end, timeout, true)
+}
+
+func (s *SqliteDb) iteratorWithTimeout(start, end []byte, timeout time.Duration, reverse bool) (Iterator, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	return s.newIterator(ctx, cancel, start, end, reverse, 0)
+}
+
+// IteratorWithLimit is like Iterator, but the scan stops after limit entries,
+// so SQLite reads no more rows than that; a limit of zero or less means no
+// limit. Passing the key following the last one returned, such as the last
+// key with a zero byte appended, as the start of the next call pages through
+// the domain without scanning it again.
+func (s *SqliteDb) IteratorWithLimit(start, end []byte, limit int) (Iterator, error) {
+	return s.newIterator(context.Background(), nil, start, end, false, limit)
+}
+
+// ReverseIteratorWithLimit is like ReverseIterator, but the scan stops after
+// limit entries; see IteratorWithLimit. The next page ends at the last key
+// returned.
+func (s *SqliteDb) ReverseIteratorWithLimit(start, end []byte, limit int) (Iterator, error) {
+	return s.newIterator(context.Background(), nil, start, end, true, limit)
+}
+
+// newIterator validates the domain, commits buffered auto-commit writes and
+// starts the scan. If cancel is non-nil, it is called when the iterator is
+// closed or could not be created. If limit is positive, the scan stops after
+// that many rows.
+func (s *SqliteDb) newIterator(
+	ctx context.Context, cancel context.CancelFunc, start, end []byte, reverse bool, limit int,
+) (itr Iterator, err error) {
+	if s.opts.observer != nil {
+		defer func(begin time.Time) { s.opts.observer("iterate", time.Since(begin), 0, 0, err) }(time.Now())
+	}
+	if !isValidDomain(start, end) {
+		if cancel != nil {
+			cancel()
+		}
 		return nil, errKeyEmpty
 	}
+	if err := s.Flush(); err != nil {
+		if cancel != nil {
+			cancel()
+		}
+		return nil, err
+	}
+
+	return newSqliteIterator(ctx, cancel, s, nil, start, end, reverse, limit)
+}
+
+// ToMap reads every entry in [start, end) into a map keyed by string(key). It
+// is meant for small datasets only, such as config-style stores and tests: it
+// returns an error rather than allocating more than limit entries.
+func (s *SqliteDb) ToMap(start, end []byte, limit int) (map[string][]byte, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid limit %d: must be positive", limit)
+	}
+
+	itr, err := s.Iterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer itr.Close()
+
+	entries := make(map[string][]byte)
+	for ; itr.Valid(); itr.Next() {
+		if len(entries) == limit {
+			return nil, fmt.Errorf("range holds more than %d entries", limit)
+		}
+		entries[string(itr.Key())] = itr.Value()
+	}
+	if err := itr.Error(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ApplyDiff atomically applies a diff between two databases: it deletes the
+// removed keys and sets the added and changed pairs in a single transaction.
+// Removals are applied first, so a key present in both lists ends up set.
+func (s *SqliteDb) ApplyDiff(added, changed []KV, removed [][]byte) error {
+	batch := s.NewBatch()
+	defer batch.Close()
 
-	return newSqliteIterator(s, start, end, true)
+	for _, key := range removed {
+		if err := batch.Delete(key); err != nil {
+			return err
+		}
+	}
+	for _, pairs := range [][]KV{added, changed} {
+		for _, kv := range pairs {
+			if err := batch.Set(kv.Key, kv.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return batch.Write()
 }
 
 func (s *SqliteDb) NewBatch() Batch {
@@ -187,11 +792,21 @@ func (s *SqliteDb) NewBatch() Batch {
 	if err != nil {
 		panic(err)
 	}
+	batch.owner = s
 	return batch
 }
 
+// NewBatchWithSize implements DB. As with goleveldb, size is the expected
+// byte size of the batch: room is preallocated for size/64 operations, 64
+// bytes being taken as the size of a typical key and value.
 func (s *SqliteDb) NewBatchWithSize(size int) Batch {
-	return s.NewBatch()
+	capacity := 0
+	if size > 0 {
+		capacity = size / sqliteBatchOpSizeHint
+	}
+	batch := newSqliteBatch(s.db, capacity)
+	batch.owner = s
+	return batch
 }
 
 func (s *SqliteDb) Print() error {
@@ -208,11 +823,296 @@ func (s *SqliteDb) Print() error {
 	return nil
 }
 
+// sqliteStatsCountMaxAge is how long Stats reuses a count of the keys, which
+// takes time proportional to the size of the store.
+const sqliteStatsCountMaxAge = time.Minute
+
+// Stats implements DB. It reports the connection pool statistics listed by
+// sqlDBStats, the size of the store and details of the SQLite library, under
+// these keys:
+//
+//	reads.*                 statistics of the read pool, with separate_read_write
+//	num_keys                number of keys in the store, see Count; counted at
+//	                        most once a minute, so it can be stale
+//	disk_size_bytes         size of the database, see DiskSize
+//	sqlite.version          version of the linked SQLite library
+//	sqlite.compile_options  comma-separated options SQLite was compiled with
 func (s *SqliteDb) Stats() map[string]string {
-	// _stats := s.db.Stats()
-	stats := make(map[string]string, 0)
-	// for _, key := range keys {
-	// 	stats[key] = s.db.Stats() // s.db.GetProperty(key)
-	// }
+	stats := sqlDBStats(s.db.Stats())
+	if s.reads != s.db {
+		for k, v := range sqlDBStats(s.reads.Stats()) {
+			stats["reads."+k] = v
+		}
+	}
+	if count, err := s.cachedCount(sqliteStatsCountMaxAge); err == nil {
+		stats["num_keys"] = strconv.FormatInt(count, 10)
+	}
+	if size, err := s.DiskSize(); err == nil {
+		stats["disk_size_bytes"] = strconv.FormatInt(size, 10)
+	}
+	if version, err := s.SQLiteVersion(); err == nil {
+		stats["sqlite.version"] = version
+	}
+	if options, err := s.CompileOptions(); err == nil {
+		stats["sqlite.compile_options"] = strings.Join(options, ",")
+	}
 	return stats
 }
+
+// DiskSize returns the size in bytes of the database file, including its -wal
+// and -shm files, which holds every namespace. For an in-memory database, it
+// returns the size of its pages instead, including those written by buffered
+// auto-commit writes.
+func (s *SqliteDb) DiskSize() (int64, error) {
+	if s.path == "" {
+		var pageCount, pageSize int64
+		err := s.read(func(q sqliteQuerier) error {
+			if err := q.QueryRow(`PRAGMA page_count;`).Scan(&pageCount); err != nil {
+				return fmt.Errorf("failed to query page count: %w", err)
+			}
+			if err := q.QueryRow(`PRAGMA page_size;`).Scan(&pageSize); err != nil {
+				return fmt.Errorf("failed to query page size: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		return pageCount * pageSize, nil
+	}
+
+	var size int64
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		info, err := os.Stat(s.path + suffix)
+		if err != nil {
+			if suffix != "" && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return 0, fmt.Errorf("failed to stat database file: %w", err)
+		}
+		size += info.Size()
+	}
+	return size, nil
+}
+
+// WithExclusive runs fn while the connection pool is drained to a single
+// connection, then restores the previous pool limits. Maintenance such as
+// VACUUM or changing auto_vacuum needs exclusive access to the database and
+// otherwise fails with "database is locked" because of other pooled
+// connections. Buffered auto-commit writes are committed first, and later
+// ones wait for fn to return, so fn must not write through the store. Iterators
+// must not be open while fn runs, or fn waits for them to be closed.
+func (s *SqliteDb) WithExclusive(fn func() error) error {
+	if s.root != nil {
+		return s.root.WithExclusive(fn)
+	}
+	s.poolMtx.Lock()
+	defer s.poolMtx.Unlock()
+
+	return s.flushed(func() error { return s.withExclusivePool(fn) })
+}
+
+// withExclusivePool runs fn with the pool drained to a single connection; see
+// WithExclusive.
+func (s *SqliteDb) withExclusivePool(fn func() error) error {
+	if s.maxOpenConns == 1 {
+		// Already a single connection, which must be kept for an in-memory
+		// database. With separate_read_write, the read connections do not
+		// hold locks unless iterators or snapshots are open.
+		return fn()
+	}
+
+	s.db.SetMaxOpenConns(1)
+	// Close every idle connection, then keep the remaining one around so that
+	// per-connection state, such as a pending PRAGMA auto_vacuum, carries over
+	// between the statements run by fn.
+	s.db.SetMaxIdleConns(0)
+	s.db.SetMaxIdleConns(1)
+	defer func() {
+		s.db.SetMaxOpenConns(s.maxOpenConns)
+		s.db.SetMaxIdleConns(s.maxIdleConns)
+	}()
+
+	return fn()
+}
+
+// Compact rebuilds the database file with VACUUM, returning the pages freed
+// by deletions to the file system, and in WAL mode truncates the write-ahead
+// log as well. VACUUM needs the database to itself, so Compact fails rather
+// than waiting while iterators or snapshots are open. Buffered auto-commit
+// writes are committed first.
+func (s *SqliteDb) Compact() error {
+	if s.root != nil {
+		return s.root.Compact()
+	}
+	iterators, snapshots := s.openReaders()
+	if iterators > 0 {
+		return fmt.Errorf("cannot compact the database: %d %w", iterators, errIteratorsOpen)
+	}
+	if snapshots > 0 {
+		return fmt.Errorf("cannot compact the database: %d %w", snapshots, errSnapshotsOpen)
+	}
+	return s.WithExclusive(func() error {
+		if _, err := s.db.Exec(`VACUUM;`); err != nil {
+			return fmt.Errorf("failed to vacuum the database: %w", err)
+		}
+		if s.opts.journalMode == "WAL" {
+			if _, err := s.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE);`); err != nil {
+				return fmt.Errorf("failed to checkpoint the WAL: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+// Backup writes a consistent, defragmented copy of the database to the new
+// file destPath with VACUUM INTO, while the store remains usable. It fails if
+// destPath already exists rather than overwriting it. Buffered auto-commit
+// writes are committed first so that the copy includes them.
+func (s *SqliteDb) Backup(destPath string) error {
+	if _, err := os.Lstat(destPath); err == nil {
+		return fmt.Errorf("backup destination '%s': %w", destPath, os.ErrExist)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to check backup destination '%s': %w", destPath, err)
+	}
+	if err := s.Flush(); err != nil {
+		return err
+	}
+	if _, err := s.db.Exec(`VACUUM INTO ?;`, destPath); err != nil {
+		return fmt.Errorf("failed to back up the database to '%s': %w", destPath, err)
+	}
+	return nil
+}
+
+// sqliteCheckpointModes are the modes of PRAGMA wal_checkpoint.
+var sqliteCheckpointModes = []string{"PASSIVE", "FULL", "RESTART", "TRUNCATE"}
+
+// SqliteCheckpoint is the outcome of a WAL checkpoint, as reported by PRAGMA
+// wal_checkpoint.
+type SqliteCheckpoint struct {
+	// Busy is set if the checkpoint was blocked by other connections.
+	Busy bool
+	// LogFrames is the number of frames in the WAL, and Checkpointed the
+	// number of them that were copied back into the database file.
+	LogFrames    int
+	Checkpointed int
+}
+
+// Checkpoint copies the content of the WAL back into the database file with
+// PRAGMA wal_checkpoint in mode, one of PASSIVE, FULL, RESTART or TRUNCATE,
+// TRUNCATE being used if mode is empty. TRUNCATE also empties the -wal file,
+// which otherwise keeps its size. Buffered auto-commit writes are committed
+// first. Checkpoint does nothing unless the database is in WAL mode.
+func (s *SqliteDb) Checkpoint(mode string) (SqliteCheckpoint, error) {
+	var res SqliteCheckpoint
+	if mode == "" {
+		mode = "TRUNCATE"
+	}
+	mode, err := parseSqlitePragmaValue("checkpoint mode", mode, sqliteCheckpointModes)
+	if err != nil {
+		return res, err
+	}
+	// Buffered auto-commit writes wait for the checkpoint, which would
+	// otherwise be blocked by their open transaction.
+	err = s.flushed(func() error {
+		// The journal mode of the file is checked rather than the option, since
+		// read-only and in-memory databases do not necessarily use the latter.
+		var journalMode string
+		if err := s.db.QueryRow(`PRAGMA journal_mode;`).Scan(&journalMode); err != nil {
+			return fmt.Errorf("failed to query journal mode: %w", err)
+		}
+		if !strings.EqualFold(journalMode, "WAL") {
+			return nil
+		}
+		err := s.db.QueryRow(fmt.Sprintf(`PRAGMA wal_checkpoint(%s);`, mode)).Scan(&res.Busy, &res.LogFrames, &res.Checkpointed)
+		if err != nil {
+			return fmt.Errorf("failed to checkpoint the WAL: %w", err)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// openIterators returns the number of iterators that are not closed yet,
+// including those of the namespace stores of the database.
+func (s *SqliteDb) openIterators() int {
+	iterators, _ := s.openReaders()
+	return iterators
+}
+
+// openReaders returns the number of iterators and snapshots that are not
+// closed yet, including those of the namespace stores of the database.
+func (s *SqliteDb) openReaders() (iterators, snapshots int) {
+	s.itrMtx.Lock()
+	iterators, snapshots = len(s.iterators), len(s.snapshots)
+	s.itrMtx.Unlock()
+
+	s.nsMtx.Lock()
+	defer s.nsMtx.Unlock()
+	for ns := range s.namespaces {
+		ns.itrMtx.Lock()
+		iterators += len(ns.iterators)
+		snapshots += len(ns.snapshots)
+		ns.itrMtx.Unlock()
+	}
+	return iterators, snapshots
+}
+
+// Schema returns the SQL definitions of the tables and indexes the package
+// created in the database file, tables first, one statement per line. It shows
+// which schema features and migrations are active on a given file.
+func (s *SqliteDb) Schema() (string, error) {
+	rows, err := s.reads.Query(`
+	SELECT sql FROM sqlite_master
+	WHERE (tbl_name LIKE 'state\_storage%' ESCAPE '\' OR tbl_name = 'schema_version')
+		AND sql IS NOT NULL
+	ORDER BY type DESC, name ASC;
+	`)
+	if err != nil {
+		return "", fmt.Errorf("failed to query schema: %w", err)
+	}
+	defer rows.Close()
+
+	var ddl []string
+	for rows.Next() {
+		var stmt string
+		if err := rows.Scan(&stmt); err != nil {
+			return "", fmt.Errorf("failed to scan schema: %w", err)
+		}
+		ddl = append(ddl, stmt+";")
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("failed to query schema: %w", err)
+	}
+	return strings.Join(ddl, "\n"), nil
+}
+
+// SQLiteVersion returns the version of the SQLite library backing the
+// database, which can differ between builds of the driver.
+func (s *SqliteDb) SQLiteVersion() (string, error) {
+	var version string
+	if err := s.reads.QueryRow(`SELECT sqlite_version();`).Scan(&version); err != nil {
+		return "", fmt.Errorf("failed to query SQLite version: %w", err)
+	}
+	return version, nil
+}
+
+// CompileOptions returns the options the SQLite library was compiled with,
+// such as ENABLE_FTS5 or THREADSAFE=1.
+func (s *SqliteDb) CompileOptions() ([]string, error) {
+	rows, err := s.reads.Query(`PRAGMA compile_options;`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SQLite compile options: %w", err)
+	}
+	defer rows.Close()
+
+	var options []string
+	for rows.Next() {
+		var option string
+		if err := rows.Scan(&option); err != nil {
+			return nil, fmt.Errorf("failed to scan SQLite compile option: %w", err)
+		}
+		options = append(options, option)
+	}
+	return options, rows.Err()
+}
@@ -0,0 +1,300 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqliteAutoCommit accumulates writes in a single long-lived transaction that
+// is committed every interval, every maxOps operations, or on an explicit
+// flush, trading durability latency for write throughput.
+//
+// The writes in the open transaction are also kept in an in-memory buffer, so
+// that Get can serve them without waiting for the transaction's connection.
+//
+// A commit that fails rolls the transaction back, dropping the buffered writes
+// although the calls that made them succeeded. The failure is reported to the
+// observer, if any, as an "autocommit" operation, and returned by the call that
+// triggered the commit, or else by the next write or flush.
+type sqliteAutoCommit struct {
+	db       *sql.DB
+	interval time.Duration
+	maxOps   int
+	observer Observer
+
+	mtx sync.Mutex
+	tx  *sql.Tx
+	ops int
+	// held is set while exclusive runs, during which no transaction begins;
+	// free is signalled when it is cleared.
+	held bool
+	free *sync.Cond
+	// pending holds the latest write to each key in the open transaction,
+	// indexed by sqlitePendingKey since namespaces share the transaction.
+	pending map[string]sqlitePendingWrite
+	// err holds a failed background commit until it can be reported to a caller.
+	err error
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// sqlitePendingWrite is a buffered write; a nil value is a delete.
+type sqlitePendingWrite struct {
+	value []byte
+}
+
+// sqlitePendingKey returns the index of key in table in the pending writes.
+func sqlitePendingKey(table sqliteTable, key []byte) string {
+	return table.name + "/" + string(key)
+}
+
+func newSqliteAutoCommit(db *sql.DB, interval time.Duration, maxOps int, observer Observer) *sqliteAutoCommit {
+	ac := &sqliteAutoCommit{
+		db:       db,
+		interval: interval,
+		maxOps:   maxOps,
+		observer: observer,
+		pending:  make(map[string]sqlitePendingWrite),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	ac.free = sync.NewCond(&ac.mtx)
+	if interval > 0 {
+		go ac.run()
+	} else {
+		close(ac.done)
+	}
+	return ac
+}
+
+func (ac *sqliteAutoCommit) run() {
+	defer close(ac.done)
+
+	ticker := time.NewTicker(ac.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ac.mtx.Lock()
+			if err := ac.commitLocked(); err != nil && ac.err == nil {
+				ac.err = err
+			}
+			ac.mtx.Unlock()
+
+		case <-ac.stop:
+			return
+		}
+	}
+}
+
+// set buffers a write of value to key in table, storing it as stored.
+func (ac *sqliteAutoCommit) set(table sqliteTable, key, value, stored []byte) error {
+	return ac.exec(table, key, sqlitePendingWrite{value: value}, table.upsert, key, stored, stored)
+}
+
+// delete buffers a delete of key in table.
+func (ac *sqliteAutoCommit) delete(table sqliteTable, key []byte) error {
+	return ac.exec(table, key, sqlitePendingWrite{}, table.del, key)
+}
+
+// update replaces the value of key with the one computed by next from the
+// open transaction, so the read and the write happen atomically.
+func (ac *sqliteAutoCommit) update(table sqliteTable, key []byte, next func(q sqliteQuerier) (value, stored []byte, err error)) error {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+
+	if err := ac.beginLocked(); err != nil {
+		return err
+	}
+	value, stored, err := next(ac.tx)
+	if err != nil {
+		return err
+	}
+	return ac.execLocked(table, key, sqlitePendingWrite{value: value}, table.upsert, key, stored, stored)
+}
+
+// upgrade rewrites key in table as stored, the current representation of
+// value, in the open transaction, unless the key no longer holds previous. A
+// write buffered since previous was read is thus never undone.
+func (ac *sqliteAutoCommit) upgrade(table sqliteTable, key, value, stored, previous []byte) error {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+
+	if _, ok := ac.pending[sqlitePendingKey(table, key)]; ok {
+		return nil
+	}
+	if err := ac.beginLocked(); err != nil {
+		return err
+	}
+	res, err := ac.tx.Exec(table.upgrade, stored, key, previous)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	ac.pending[sqlitePendingKey(table, key)] = sqlitePendingWrite{value: value}
+	ac.ops++
+	if ac.maxOps > 0 && ac.ops >= ac.maxOps {
+		return ac.commitLocked()
+	}
+	return nil
+}
+
+// lookup returns the buffered write to key in table, if any.
+func (ac *sqliteAutoCommit) lookup(table sqliteTable, key []byte) (sqlitePendingWrite, bool) {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+
+	w, ok := ac.pending[sqlitePendingKey(table, key)]
+	return w, ok
+}
+
+// exec runs a write statement for key in the open transaction, beginning one
+// if needed, records it as pending, and commits once maxOps operations have
+// accumulated.
+func (ac *sqliteAutoCommit) exec(table sqliteTable, key []byte, w sqlitePendingWrite, query string, args ...any) error {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+
+	if err := ac.beginLocked(); err != nil {
+		return err
+	}
+	return ac.execLocked(table, key, w, query, args...)
+}
+
+// beginLocked waits for exclusive to return, reports any earlier background
+// commit failure and otherwise makes sure a transaction is open.
+func (ac *sqliteAutoCommit) beginLocked() error {
+	for ac.held {
+		ac.free.Wait()
+	}
+	if err := ac.takeErr(); err != nil {
+		return err
+	}
+	if ac.tx == nil {
+		tx, err := ac.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to create SQL transaction: %w", err)
+		}
+		ac.tx = tx
+	}
+	return nil
+}
+
+func (ac *sqliteAutoCommit) execLocked(table sqliteTable, key []byte, w sqlitePendingWrite, query string, args ...any) error {
+	if _, err := ac.tx.Exec(query, args...); err != nil {
+		return err
+	}
+	ac.pending[sqlitePendingKey(table, key)] = w
+
+	ac.ops++
+	if ac.maxOps > 0 && ac.ops >= ac.maxOps {
+		return ac.commitLocked()
+	}
+	return nil
+}
+
+// read runs fn against the open transaction so that it observes writes which
+// have not been committed yet. It reports false without calling fn when no
+// transaction is open.
+func (ac *sqliteAutoCommit) read(fn func(q sqliteQuerier) error) (bool, error) {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+
+	if ac.tx == nil {
+		return false, nil
+	}
+	return true, fn(ac.tx)
+}
+
+// flush commits the open transaction, if any, and reports any earlier
+// background commit failure.
+func (ac *sqliteAutoCommit) flush() error {
+	ac.mtx.Lock()
+	defer ac.mtx.Unlock()
+
+	if err := ac.commitLocked(); err != nil {
+		return err
+	}
+	return ac.takeErr()
+}
+
+// exclusive commits the open transaction, reporting any earlier background
+// commit failure, and runs fn before another transaction can begin: buffered
+// writes wait for fn to return, so that the writes made by fn never wait for
+// the write lock of the auto-commit transaction. Reads are not held up, but fn
+// must not write through the auto-commit transaction itself.
+func (ac *sqliteAutoCommit) exclusive(fn func() error) error {
+	ac.mtx.Lock()
+	for ac.held {
+		ac.free.Wait()
+	}
+	err := ac.commitLocked()
+	if err == nil {
+		err = ac.takeErr()
+	}
+	if err != nil {
+		ac.mtx.Unlock()
+		return err
+	}
+	ac.held = true
+	ac.mtx.Unlock()
+
+	defer func() {
+		ac.mtx.Lock()
+		ac.held = false
+		ac.free.Broadcast()
+		ac.mtx.Unlock()
+	}()
+	return fn()
+}
+
+func (ac *sqliteAutoCommit) commitLocked() (err error) {
+	if ac.tx == nil {
+		return nil
+	}
+	if ac.observer != nil {
+		var keySize, valueSize int
+		for k, w := range ac.pending {
+			// Table names hold no slash; see sqlitePendingKey.
+			keySize += len(k) - strings.IndexByte(k, '/') - 1
+			valueSize += len(w.value)
+		}
+		defer func(begin time.Time) {
+			ac.observer("autocommit", time.Since(begin), keySize, valueSize, err)
+		}(time.Now())
+	}
+
+	// The pending writes are dropped along with the transaction if the commit
+	// fails: it is rolled back, and cannot be committed again.
+	err = ac.tx.Commit()
+	ac.tx = nil
+	ac.ops = 0
+	ac.pending = make(map[string]sqlitePendingWrite)
+	if err != nil {
+		return fmt.Errorf("failed to write SQL transaction: %w", err)
+	}
+	return nil
+}
+
+func (ac *sqliteAutoCommit) takeErr() error {
+	err := ac.err
+	ac.err = nil
+	return err
+}
+
+// close stops the background committer and commits any pending writes.
+func (ac *sqliteAutoCommit) close() error {
+	select {
+	case <-ac.stop:
+	default:
+		close(ac.stop)
+	}
+	<-ac.done
+	return ac.flush()
+}
@@ -1,8 +1,10 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"time"
 )
 
 var _ Batch = (*sqliteBatch)(nil)
@@ -14,130 +16,267 @@ const (
 	batchActionDel batchAction = 1
 )
 
-type sqliteBatchOp struct {
+// sqlBatchOp is an operation buffered by a batch of a SQL backend.
+type sqlBatchOp struct {
 	action     batchAction
 	key, value []byte
 }
 
+// sqliteBatch buffers operations in memory and applies them in a single
+// transaction on Write. The transaction is only begun then, so an open batch
+// does not hold on to a pooled connection.
 type sqliteBatch struct {
-	db   *sql.DB
-	tx   *sql.Tx
-	ops  []sqliteBatchOp
-	size int
+	db     *sql.DB
+	ops    []sqlBatchOp
+	size   int
+	closed bool
+	// capacity is the number of operations preallocated on Reset.
+	capacity int
+	// owner is the SqliteDb that created the batch, if any. Its value codec
+	// and read cache apply to the batch.
+	owner *SqliteDb
 }
 
+// sqliteBatchOpSizeHint is the average size, in bytes, of the key and value
+// of an operation, used to turn a batch byte size into a number of operations.
+const sqliteBatchOpSizeHint = 64
+
 func NewBatch(db *sql.DB) (*sqliteBatch, error) {
-	tx, err := db.Begin()
-	if err != nil {
-		return nil, fmt.Errorf("failed to create SQL transaction: %w", err)
-	}
+	return newSqliteBatch(db, 0), nil
+}
 
+// newSqliteBatch returns a batch with room for capacity operations.
+func newSqliteBatch(db *sql.DB, capacity int) *sqliteBatch {
 	return &sqliteBatch{
-		db:  db,
-		tx:  tx,
-		ops: make([]sqliteBatchOp, 0),
-	}, nil
+		db:       db,
+		ops:      make([]sqlBatchOp, 0, capacity),
+		capacity: capacity,
+	}
 }
 
 func (b *sqliteBatch) Size() int {
 	return b.size
 }
 
+// Reset discards the operations of the batch and reopens it, so that a written
+// or closed batch can be reused.
 func (b *sqliteBatch) Reset() error {
-	b.ops = nil
-	b.ops = make([]sqliteBatchOp, 0)
+	b.ops = make([]sqlBatchOp, 0, b.capacity)
 	b.size = 0
-
-	tx, err := b.db.Begin()
-	if err != nil {
-		return err
-	}
-
-	b.tx = tx
+	b.closed = false
 	return nil
 }
 
 func (b *sqliteBatch) Set(key, value []byte) error {
+	if b.readOnly() {
+		return errReadOnly
+	}
 	if len(key) == 0 {
 		return errKeyEmpty
 	}
 	if value == nil {
 		return errValueNil
 	}
-	if b.tx == nil {
+	if b.closed {
 		return errBatchClosed
 	}
 	b.size += len(key) + len(value)
-	b.ops = append(b.ops, sqliteBatchOp{action: batchActionSet, key: key, value: value})
+	if b.owner != nil {
+		encoded, err := b.owner.encode(value)
+		if err != nil {
+			return err
+		}
+		value = encoded
+	}
+	b.ops = append(b.ops, sqlBatchOp{action: batchActionSet, key: key, value: value})
 	return nil
 }
 
 func (b *sqliteBatch) Delete(key []byte) error {
+	if b.readOnly() {
+		return errReadOnly
+	}
 	if len(key) == 0 {
 		return errKeyEmpty
 	}
-	if b.tx == nil {
+	if b.closed {
 		return errBatchClosed
 	}
 	b.size += len(key)
-	b.ops = append(b.ops, sqliteBatchOp{action: batchActionDel, key: key})
+	b.ops = append(b.ops, sqlBatchOp{action: batchActionDel, key: key})
 	return nil
 }
 
+// Write implements Batch. After a successful Write the batch is empty and
+// closed: it must be Reset before it is used again, and writing it again
+// returns errBatchClosed.
 func (b *sqliteBatch) Write() error {
-	if b.tx == nil {
+	return b.write(false)
+}
+
+// write applies the batch; if durable is set, its transaction is synced to
+// disk before write returns, as with SqliteDb.SetSync.
+func (b *sqliteBatch) write(durable bool) (err error) {
+	if b.owner != nil && b.owner.opts.observer != nil {
+		var keySize, valueSize int
+		for _, op := range b.ops {
+			keySize += len(op.key)
+			valueSize += len(op.value)
+		}
+		defer func(begin time.Time) {
+			b.owner.opts.observer("batch_write", time.Since(begin), keySize, valueSize, err)
+		}(time.Now())
+	}
+	if b.closed {
 		return errBatchClosed
 	}
-	for _, op := range b.ops {
-		switch op.action {
-		case batchActionSet:
-			_, err := b.tx.Exec(upsertStmt, op.key, op.value, op.value)
-			if err != nil {
-				return fmt.Errorf("failed to exec batch set SQL statement: %w", err)
+	if b.readOnly() {
+		return errReadOnly
+	}
+	if b.owner != nil {
+		// Commit the auto-commit transaction first so the two never contend
+		// for the write lock.
+		if ac := b.owner.ac; ac != nil {
+			ac.mtx.Lock()
+			defer ac.mtx.Unlock()
+			if err := ac.commitLocked(); err != nil {
+				return err
 			}
+		}
+	}
+	// A transaction failing with SQLITE_BUSY or SQLITE_LOCKED, even on
+	// commit, is rolled back as a whole, so it is retried from the start.
+	ctx := context.Background()
+	commit := func() error { return b.commit(b.db) }
+	switch {
+	case b.owner != nil && durable:
+		commit = func() error { return b.owner.durable(ctx, b.commit) }
+	case b.owner != nil:
+		commit = func() error { return b.owner.opts.retryBusy(ctx, func() error { return b.commit(b.db) }) }
+	case durable:
+		commit = func() error {
+			return withSqliteSynchronousFull(ctx, b.db, func(conn *sql.Conn) error { return b.commit(conn) })
+		}
+	}
+	if err = commit(); err != nil {
+		return err
+	}
+	if b.owner != nil {
+		b.invalidate()
+	}
+	b.ops = nil
+	b.size = 0
+	b.closed = true
 
-		case batchActionDel:
-			_, err := b.tx.Exec(delStmt, op.key)
-			if err != nil {
+	return nil
+}
+
+// commit applies the batch operations in a new transaction on q.
+func (b *sqliteBatch) commit(q sqliteTxExecer) error {
+	tx, err := q.BeginTx(context.Background(), nil)
+	if err != nil {
+		return fmt.Errorf("failed to create SQL transaction: %w", err)
+	}
+	if err := b.exec(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to write SQL transaction: %w", err)
+	}
+	return nil
+}
+
+// sqliteBatchMaxSetRows is the number of sets written by a single statement,
+// each of which binds a key and a value.
+const sqliteBatchMaxSetRows = sqliteMaxParams / 2
+
+// exec applies the batch operations within tx, in order. Each run of
+// consecutive sets is written with multi-row statements, of up to
+// sqliteBatchMaxSetRows rows, rather than one statement per operation.
+func (b *sqliteBatch) exec(tx *sql.Tx) error {
+	table := b.table()
+	fullUpsert := ""
+	for i := 0; i < len(b.ops); {
+		if b.ops[i].action == batchActionDel {
+			if _, err := tx.Exec(table.del, b.ops[i].key); err != nil {
 				return fmt.Errorf("failed to exec batch del SQL statement: %w", err)
 			}
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j < len(b.ops) && j-i < sqliteBatchMaxSetRows && b.ops[j].action == batchActionSet {
+			j++
+		}
+		args := make([]any, 0, 2*(j-i))
+		for _, op := range b.ops[i:j] {
+			args = append(args, op.key, op.value)
+		}
+		var upsert string
+		if j-i == sqliteBatchMaxSetRows {
+			if fullUpsert == "" {
+				fullUpsert = table.upsertRows(sqliteBatchMaxSetRows)
+			}
+			upsert = fullUpsert
+		} else {
+			upsert = table.upsertRows(j - i)
+		}
+		if _, err := tx.Exec(upsert, args...); err != nil {
+			return fmt.Errorf("failed to exec batch set SQL statement: %w", err)
 		}
+		i = j
 	}
+	return nil
+}
 
-	if err := b.tx.Commit(); err != nil {
-		return fmt.Errorf("failed to write SQL transaction: %w", err)
+// table returns the table of the owner's namespace, or the default one for a
+// batch created by NewBatch.
+func (b *sqliteBatch) table() sqliteTable {
+	if b.owner != nil {
+		return b.owner.table
 	}
-	b.tx = nil
+	return newSqliteTable(sqliteDefaultNamespace)
+}
 
-	return nil
+// readOnly reports whether the batch belongs to a read-only store.
+func (b *sqliteBatch) readOnly() bool {
+	return b.owner != nil && b.owner.opts.readOnly
+}
+
+// invalidate drops the keys written by the batch from the owner's read cache.
+func (b *sqliteBatch) invalidate() {
+	if b.owner.opts.readCache == nil {
+		return
+	}
+	keys := make([][]byte, 0, len(b.ops))
+	for _, op := range b.ops {
+		keys = append(keys, op.key)
+	}
+	b.owner.invalidate(keys...)
 }
 
 // Close implements Batch.
 func (b *sqliteBatch) Close() error {
-	if b.tx != nil {
-		err := b.tx.Rollback()
-		if err != nil {
-			return err
-		}
-		b.tx = nil
-	}
+	b.closed = true
 	return nil
 }
 
 func (b *sqliteBatch) GetByteSize() (int, error) {
-	if b.tx == nil {
+	if b.closed {
 		return 0, errBatchClosed
 	}
 	return b.size, nil
 }
 
-// WriteSync implements Batch.
+// WriteSync implements Batch. Unlike Write, the batch is synced to disk before
+// WriteSync returns; see SqliteDb.SetSync.
 func (b *sqliteBatch) WriteSync() error {
-	if b.tx == nil {
+	if b.closed {
 		return errBatchClosed
 	}
-	// err := b.db.db.Write(b.db.woSync, b.batch)
-	err := b.Write()
+	err := b.write(true)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// sqliteStoreIDs hands out the identifiers that keep the entries of different
+// stores apart in a shared ReadCache.
+var sqliteStoreIDs atomic.Uint64
+
+// ReadCache is an LRU cache of values read from SqliteDb stores, bounded by
+// the total size of the cached keys and values. A single ReadCache can be
+// shared by several stores, for example namespaces of one database file, to
+// cap their combined cache memory; entries are keyed by store so stores never
+// observe each other's values.
+//
+// Entries are only invalidated by the writes made through the stores using the
+// cache. Writes made to the same database file by a store without it, by
+// another ReadCache or by another process leave stale values in the cache, so
+// it should only be used when the stores sharing it are the only writers.
+type ReadCache struct {
+	mtx      sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	entries  map[readCacheKey]*list.Element
+	// epochs counts the invalidations of each store. A value read from the
+	// database is only cached if no write to its store landed while it was
+	// being read, so a concurrent write can never be shadowed by stale data.
+	epochs map[uint64]uint64
+}
+
+type readCacheKey struct {
+	store uint64
+	key   string
+}
+
+type readCacheEntry struct {
+	key   readCacheKey
+	value []byte
+}
+
+// NewReadCache creates a ReadCache holding at most maxBytes of keys and values.
+func NewReadCache(maxBytes int64) *ReadCache {
+	return &ReadCache{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[readCacheKey]*list.Element),
+		epochs:   make(map[uint64]uint64),
+	}
+}
+
+// Size returns the total size in bytes of the cached keys and values.
+func (c *ReadCache) Size() int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.size
+}
+
+// Len returns the number of cached entries.
+func (c *ReadCache) Len() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.lru.Len()
+}
+
+// get returns a copy of the cached value of key in store, and the current
+// epoch of store to pass to put on a miss.
+func (c *ReadCache) get(store uint64, key []byte) ([]byte, uint64, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	elem, ok := c.entries[readCacheKey{store: store, key: string(key)}]
+	if !ok {
+		return nil, c.epochs[store], false
+	}
+	c.lru.MoveToFront(elem)
+	return cp(elem.Value.(*readCacheEntry).value), 0, true
+}
+
+// put caches value for key in store, unless store was written to since epoch
+// was obtained from get.
+func (c *ReadCache) put(store uint64, key, value []byte, epoch uint64) {
+	entrySize := int64(len(key) + len(value))
+	if entrySize > c.maxBytes {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.epochs[store] != epoch {
+		return
+	}
+	ck := readCacheKey{store: store, key: string(key)}
+	if elem, ok := c.entries[ck]; ok {
+		c.removeElement(elem)
+	}
+	c.entries[ck] = c.lru.PushFront(&readCacheEntry{key: ck, value: cp(value)})
+	c.size += entrySize
+	for c.size > c.maxBytes {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// invalidate drops the cached value of each key in store.
+func (c *ReadCache) invalidate(store uint64, keys ...[]byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.epochs[store]++
+	for _, key := range keys {
+		if elem, ok := c.entries[readCacheKey{store: store, key: string(key)}]; ok {
+			c.removeElement(elem)
+		}
+	}
+}
+
+// invalidateRange drops the cached values of the keys of store in [start,
+// end), where a nil start or end leaves that side unbounded.
+func (c *ReadCache) invalidateRange(store uint64, start, end []byte) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.epochs[store]++
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		key := elem.Value.(*readCacheEntry).key
+		if key.store == store && (start == nil || key.key >= string(start)) && (end == nil || key.key < string(end)) {
+			c.removeElement(elem)
+		}
+		elem = next
+	}
+}
+
+// dropStore removes every entry of store, releasing its share of the budget.
+func (c *ReadCache) dropStore(store uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if elem.Value.(*readCacheEntry).key.store == store {
+			c.removeElement(elem)
+		}
+		elem = next
+	}
+	delete(c.epochs, store)
+}
+
+func (c *ReadCache) removeElement(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*readCacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.key.key) + len(entry.value))
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+var (
+	// errSqliteNoCipher is returned when an encryption key is configured but
+	// the linked SQLite library is not SQLCipher, which would silently ignore
+	// the key and leave the database unencrypted.
+	errSqliteNoCipher = errors.New("encryption_key requires go-sqlite3 to be linked against SQLCipher")
+
+	// errSqliteWrongKey is returned when the database cannot be read with the
+	// configured encryption key, or without one.
+	errSqliteWrongKey = errors.New("database is encrypted with another key, or is not a database")
+)
+
+// applyKey sets the encryption key of a new connection, which must happen
+// before any other statement, then checks that SQLCipher is available and that
+// the key opens the database.
+func (c *sqliteConnector) applyKey(conn *sqlite3.SQLiteConn) error {
+	pragma := fmt.Sprintf("PRAGMA key = '%s';", strings.ReplaceAll(c.key, "'", "''"))
+	if _, err := conn.Exec(pragma, nil); err != nil {
+		return fmt.Errorf("failed to set the encryption key: %w", err)
+	}
+
+	rows, err := conn.Query(`PRAGMA cipher_version;`, nil)
+	if err != nil {
+		return fmt.Errorf("failed to query the cipher version: %w", err)
+	}
+	err = rows.Next(make([]driver.Value, 1))
+	_ = rows.Close()
+	if errors.Is(err, io.EOF) {
+		return errSqliteNoCipher
+	} else if err != nil {
+		return fmt.Errorf("failed to query the cipher version: %w", err)
+	}
+
+	// The key is only checked once the database is read.
+	if _, err := conn.Exec(`SELECT count(*) FROM sqlite_master;`, nil); err != nil {
+		return wrapSqliteNotADB(err)
+	}
+	return nil
+}
+
+// wrapSqliteNotADB turns the SQLITE_NOTADB error returned when reading an
+// encrypted database without its key into errSqliteWrongKey.
+func wrapSqliteNotADB(err error) error {
+	var serr sqlite3.Error
+	if errors.As(err, &serr) && serr.Code == sqlite3.ErrNotADB {
+		return fmt.Errorf("%w: %v", errSqliteWrongKey, err)
+	}
+	return err
+}
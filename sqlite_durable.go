@@ -0,0 +1,60 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+)
+
+// sqliteTxExecer is implemented by both *sql.DB and *sql.Conn.
+type sqliteTxExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// durable runs fn, retrying it while the database is busy, so that the writes
+// it commits survive a crash of the process or of the operating system.
+//
+// By default connections run with synchronous=NORMAL, which in WAL mode does
+// not sync the WAL on commit: the latest transactions can be lost on power
+// failure, though never corrupted. Unless the synchronous option already
+// makes every commit durable, fn gets a connection switched to FULL for the
+// time of the call, which syncs the WAL, or the rollback journal and the
+// database file, before each commit returns. The cost is one fsync per commit.
+func (s *SqliteDb) durable(ctx context.Context, fn func(q sqliteTxExecer) error) error {
+	if s.opts.inMemory || s.opts.synchronous == "FULL" || s.opts.synchronous == "EXTRA" {
+		return s.opts.retryBusy(ctx, func() error { return fn(s.db) })
+	}
+	return withSqliteSynchronousFull(ctx, s.db, func(conn *sql.Conn) error {
+		return s.opts.retryBusy(ctx, func() error { return fn(conn) })
+	})
+}
+
+// withSqliteSynchronousFull runs fn on a connection of db set to
+// synchronous=FULL, then restores its setting before releasing it to the pool.
+func withSqliteSynchronousFull(ctx context.Context, db *sql.DB, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+	defer conn.Close()
+
+	var previous int
+	if err := conn.QueryRowContext(ctx, `PRAGMA synchronous;`).Scan(&previous); err != nil {
+		return fmt.Errorf("failed to query synchronous mode: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, `PRAGMA synchronous = FULL;`); err != nil {
+		return fmt.Errorf("failed to exec %q: %w", "PRAGMA synchronous = FULL;", err)
+	}
+	defer func() {
+		restore := fmt.Sprintf(`PRAGMA synchronous = %d;`, previous)
+		if _, err := conn.ExecContext(context.Background(), restore); err != nil {
+			// Drop the connection rather than leaving it slower than the
+			// others in the pool.
+			_ = conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+	}()
+
+	return fn(conn)
+}
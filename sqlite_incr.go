@@ -0,0 +1,119 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Incr atomically adds delta to the counter stored under key and returns the
+// new value. Counters are stored as 8-byte big-endian int64 values, and an
+// absent key counts as zero. It fails without writing if the existing value is
+// not 8 bytes long or if the addition overflows.
+func (s *SqliteDb) Incr(key []byte, delta int64) (int64, error) {
+	if s.opts.readOnly {
+		return 0, errReadOnly
+	}
+	if len(key) == 0 {
+		return 0, errKeyEmpty
+	}
+
+	var counter int64
+	next := func(q sqliteQuerier) (value, stored []byte, err error) {
+		var current []byte
+		err = q.QueryRow(s.table.get, key).Scan(&current)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			counter = 0
+		case err != nil:
+			return nil, nil, fmt.Errorf("failed to query row: %w", err)
+		default:
+			if s.opts.decodeValue != nil {
+				if current, _, err = s.opts.decodeValue(current); err != nil {
+					return nil, nil, fmt.Errorf("failed to decode value: %w", err)
+				}
+			}
+			if len(current) != 8 {
+				return nil, nil, fmt.Errorf("value of key %X is not an 8-byte counter: got %d bytes", key, len(current))
+			}
+			counter = int64(binary.BigEndian.Uint64(current))
+		}
+
+		if (delta > 0 && counter > math.MaxInt64-delta) || (delta < 0 && counter < math.MinInt64-delta) {
+			return nil, nil, fmt.Errorf("incrementing counter %d by %d overflows int64", counter, delta)
+		}
+		counter += delta
+
+		value = make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(counter))
+		stored, err = s.encode(value)
+		return value, stored, err
+	}
+
+	defer s.invalidate(key)
+	if s.ac != nil {
+		if err := s.ac.update(s.table, key, next); err != nil {
+			return 0, err
+		}
+		return counter, nil
+	}
+
+	err := withSqliteImmediateTx(s.db, func(tx sqliteImmediateTx) error {
+		_, stored, err := next(tx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.conn.ExecContext(context.Background(), s.table.upsert, key, stored, stored)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return counter, nil
+}
+
+// sqliteImmediateTx is a transaction started with BEGIN IMMEDIATE, which takes
+// the write lock up front. Read-modify-write transactions need it: a deferred
+// transaction that reads first fails with SQLITE_BUSY, without waiting, when it
+// later tries to write after another connection has committed.
+type sqliteImmediateTx struct {
+	conn *sql.Conn
+}
+
+// Query implements sqliteQuerier.
+func (tx sqliteImmediateTx) Query(query string, args ...any) (*sql.Rows, error) {
+	return tx.conn.QueryContext(context.Background(), query, args...)
+}
+
+// QueryRow implements sqliteQuerier.
+func (tx sqliteImmediateTx) QueryRow(query string, args ...any) *sql.Row {
+	return tx.conn.QueryRowContext(context.Background(), query, args...)
+}
+
+// withSqliteImmediateTx runs fn in a BEGIN IMMEDIATE transaction on a
+// dedicated connection of db, committing if fn succeeds and rolling back
+// otherwise.
+func withSqliteImmediateTx(db *sql.DB, fn func(tx sqliteImmediateTx) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE;`); err != nil {
+		return fmt.Errorf("failed to create SQL transaction: %w", err)
+	}
+	if err := fn(sqliteImmediateTx{conn: conn}); err != nil {
+		_, _ = conn.ExecContext(ctx, `ROLLBACK;`)
+		return err
+	}
+	if _, err := conn.ExecContext(ctx, `COMMIT;`); err != nil {
+		_, _ = conn.ExecContext(ctx, `ROLLBACK;`)
+		return fmt.Errorf("failed to write SQL transaction: %w", err)
+	}
+	return nil
+}
@@ -2,10 +2,10 @@ package db
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"slices"
-	"strings"
 )
 
 var _ Iterator = (*sqliteIterator)(nil)
@@ -15,74 +15,68 @@ type sqliteIterator struct {
 	rows       *sql.Rows
 	key, val   []byte
 	start, end []byte
+	reverse    bool
 	valid      bool
 	err        error
+	decode     ValueDecoder
+	// db is the store the iterator reads from, which tracks it while it is
+	// open unless snap is set, in which case the snapshot does.
+	db   *SqliteDb
+	snap *sqliteSnapshot
+	// ctx bounds the scan; cancel releases it, if set.
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
-func newSqliteIterator(db *SqliteDb, start, end []byte, reverse bool) (*sqliteIterator, error) {
-	var (
-		keyClause = []string{}
-		queryArgs = []any{}
-	)
-
-	switch {
-	case start != nil && end != nil:
-		if reverse {
-			keyClause = append(keyClause, "key >= ?", "key < ?")
-		} else {
-			keyClause = append(keyClause, "key >= ?", "key < ?")
-		}
-		queryArgs = []any{start, end}
-
-	case start != nil && end == nil:
-		if reverse {
-			keyClause = append(keyClause, "key >= ?")
-		} else {
-			keyClause = append(keyClause, "key >= ?")
-		}
-		queryArgs = []any{start}
-
-	case start == nil && end != nil:
-		if reverse {
-			keyClause = append(keyClause, "key < ?") // <=
-		} else {
-			keyClause = append(keyClause, "key < ?")
-		}
-		queryArgs = []any{end}
-
-	default:
-		queryArgs = []any{}
-	}
-
+// newSqliteIterator starts a scan over [start, end) that is aborted once ctx is
+// done. If cancel is non-nil, it is called when the iterator is closed. If snap
+// is non-nil, the scan runs in the snapshot's transaction. If limit is
+// positive, the scan stops after that many rows.
+func newSqliteIterator(
+	ctx context.Context, cancel context.CancelFunc, db *SqliteDb, snap *sqliteSnapshot,
+	start, end []byte, reverse bool, limit int,
+) (*sqliteIterator, error) {
+	// Both directions scan the same half-open domain [start, end); only the
+	// order differs, so a reverse scan starts at the largest key below end.
+	whereClause, queryArgs := rangeClause(start, end)
 	orderBy := "ASC"
 	if reverse {
 		orderBy = "DESC"
 	}
-
-	whereClause := "1=1"
-	if len(keyClause) > 0 {
-		whereClause = strings.Join(keyClause, " AND ")
+	if limit > 0 {
+		orderBy += " LIMIT ?"
+		queryArgs = append(queryArgs, limit)
 	}
 
 	// Note, this is not susceptible to SQL injection because placeholders are used
-	// for parts of the query outside the store's direct control.
+	// for parts of the query outside the store's direct control. Keys are
+	// unique, and BLOB keys sort bytewise.
 	cmd := fmt.Sprintf(`
-	SELECT x.key, x.value
-	FROM (
-		SELECT key, value,
-			row_number() OVER (PARTITION BY key) AS _rn
-			FROM state_storage WHERE %s
-		) x
-	WHERE x._rn = 1 ORDER BY x.key %s;
-	`, whereClause, orderBy)
-	stmt, err := db.db.Prepare(cmd)
+	SELECT key, value FROM %s
+	WHERE %s ORDER BY key %s;
+	`, db.table.name, whereClause, orderBy)
+	var (
+		stmt *sql.Stmt
+		err  error
+	)
+	if snap != nil {
+		stmt, err = snap.tx.PrepareContext(ctx, cmd)
+	} else {
+		stmt, err = db.reads.PrepareContext(ctx, cmd)
+	}
 	if err != nil {
+		if cancel != nil {
+			cancel()
+		}
 		return nil, fmt.Errorf("failed to prepare iterator SQL statement: %w", err)
 	}
 
-	rows, err := stmt.Query(queryArgs...)
+	rows, err := stmt.QueryContext(ctx, queryArgs...)
 	if err != nil {
 		_ = stmt.Close()
+		if cancel != nil {
+			cancel()
+		}
 		return nil, fmt.Errorf("failed to execute iterator SQL query: %w", err)
 	}
 
@@ -91,26 +85,34 @@ func newSqliteIterator(db *SqliteDb, start, end []byte, reverse bool) (*sqliteIt
 		rows:      rows,
 		start:     start,
 		end:       end,
-		valid:     rows.Next(),
-	}
-
-	if !itr.valid {
-		return itr, nil
+		reverse:   reverse,
+		decode:    db.opts.decodeValue,
+		db:        db,
+		snap:      snap,
+		ctx:       ctx,
+		cancel:    cancel,
 	}
+	itr.track(true)
 
 	// read the first row
-	itr.parseRow()
-	if !itr.valid {
-		return itr, nil
-	}
-
+	itr.next()
 	return itr, nil
 }
 
 func (itr *sqliteIterator) Close() (err error) {
+	if itr.rows != nil {
+		err = itr.rows.Close()
+	}
 	if itr.statement != nil {
-		err = itr.statement.Close()
+		if serr := itr.statement.Close(); err == nil {
+			err = serr
+		}
 	}
+	if itr.cancel != nil {
+		itr.cancel()
+		itr.cancel = nil
+	}
+	itr.track(false)
 
 	itr.valid = false
 	itr.statement = nil
@@ -119,6 +121,22 @@ func (itr *sqliteIterator) Close() (err error) {
 	return err
 }
 
+// track registers the open iterator with the store or snapshot that closes
+// it, or deregisters it.
+func (itr *sqliteIterator) track(open bool) {
+	mtx, iterators := &itr.db.itrMtx, itr.db.iterators
+	if itr.snap != nil {
+		mtx, iterators = &itr.snap.mtx, itr.snap.iterators
+	}
+	mtx.Lock()
+	defer mtx.Unlock()
+	if open {
+		iterators[itr] = struct{}{}
+	} else {
+		delete(iterators, itr)
+	}
+}
+
 // Domain returns the domain of the iterator. The caller must not modify the
 // return values.
 func (itr *sqliteIterator) Domain() ([]byte, []byte) {
@@ -135,36 +153,41 @@ func (itr *sqliteIterator) Value() []byte {
 	return slices.Clone(itr.val)
 }
 
+// Valid implements Iterator. It only reports the state left by the last move
+// of the iterator, so it may be called any number of times.
 func (itr *sqliteIterator) Valid() bool {
-	if !itr.valid || itr.rows.Err() != nil {
-		itr.valid = false
-		return itr.valid
-	}
-	key := itr.Key()
-	if end := itr.end; end != nil && bytes.Compare(key, end) >= 0 {
-		itr.valid = false
-		return itr.valid
-	}
-
-	if start := itr.start; start != nil && bytes.Compare(key, start) < 0 {
-		itr.valid = false
-		return itr.valid
-	}
-
-	return true
+	return itr.valid
 }
 
 func (itr *sqliteIterator) Next() {
 	itr.assertIsValid()
-	if itr.rows.Next() {
-		itr.parseRow()
+	// database/sql closes the rows of a done context asynchronously; check it
+	// here so that no row is returned past that point.
+	if err := itr.ctx.Err(); err != nil {
+		itr.err = err
+		itr.valid = false
 		return
 	}
+	itr.next()
+}
 
-	itr.valid = false
+// next reads the next row. The iterator is left invalid at the end of the
+// scan, past its domain, or on error, which Error then reports.
+func (itr *sqliteIterator) next() {
+	if !itr.rows.Next() {
+		itr.err = itr.rows.Err()
+		itr.valid = false
+		return
+	}
+	itr.valid = itr.parseRow()
 }
 
+// Error implements Iterator. A scan aborted by its timeout or context reports
+// the context's error.
 func (itr *sqliteIterator) Error() error {
+	if itr.rows == nil {
+		return itr.err
+	}
 	if err := itr.rows.Err(); err != nil {
 		return err
 	}
@@ -172,19 +195,41 @@ func (itr *sqliteIterator) Error() error {
 	return itr.err
 }
 
-func (itr *sqliteIterator) parseRow() {
+// parseRow reads the current row into the iterator. It reports false if the
+// row is past the domain or could not be read, recording the error if any.
+func (itr *sqliteIterator) parseRow() bool {
 	var (
 		key   []byte
 		value []byte
 	)
 	if err := itr.rows.Scan(&key, &value); err != nil {
 		itr.err = fmt.Errorf("failed to scan row: %w", err)
-		itr.valid = false
-		return
+		return false
+	}
+	// The query already bounds the rows; check the bound the scan is moving
+	// towards as a safeguard, like the other backends do.
+	if itr.reverse {
+		if start := itr.start; start != nil && bytes.Compare(key, start) < 0 {
+			return false
+		}
+	} else {
+		if end := itr.end; end != nil && bytes.Compare(key, end) >= 0 {
+			return false
+		}
+	}
+
+	if itr.decode != nil {
+		decoded, _, err := itr.decode(value)
+		if err != nil {
+			itr.err = fmt.Errorf("failed to decode value: %w", err)
+			return false
+		}
+		value = decoded
 	}
 
 	itr.key = key
 	itr.val = value
+	return true
 }
 
 func (itr *sqliteIterator) assertIsValid() {
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// sqliteMaxParams is the default limit on the number of host parameters in a
+// single SQLite statement (SQLITE_MAX_VARIABLE_NUMBER before SQLite 3.32).
+const sqliteMaxParams = 999
+
+// MultiGet fetches the values of keys, in the same order, with nil for the
+// keys that do not exist. The keys are looked up with as few queries as the
+// SQLite host parameter limit allows rather than one query per key. Unlike
+// Get, it does not use the read cache nor rewrite values in an outdated
+// format.
+func (s *SqliteDb) MultiGet(keys [][]byte) ([][]byte, error) {
+	values := make([][]byte, len(keys))
+	// Positions of each key that still needs to be read from the database.
+	pending := make(map[string][]int, len(keys))
+	for i, key := range keys {
+		if len(key) == 0 {
+			return nil, errKeyEmpty
+		}
+		if s.ac != nil {
+			if w, ok := s.ac.lookup(s.table, key); ok {
+				if w.value != nil {
+					values[i] = cp(w.value)
+				}
+				continue
+			}
+		}
+		pending[string(key)] = append(pending[string(key)], i)
+	}
+	if len(pending) == 0 {
+		return values, nil
+	}
+
+	args := make([]any, 0, len(pending))
+	for key := range pending {
+		args = append(args, []byte(key))
+	}
+	err := s.readCommitted(func(q sqliteQuerier) error {
+		for len(args) > 0 {
+			n := len(args)
+			if n > sqliteMaxParams {
+				n = sqliteMaxParams
+			}
+			if err := s.multiGetChunk(q, args[:n], pending, values); err != nil {
+				return err
+			}
+			args = args[n:]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// multiGetChunk reads the values of keys, at most sqliteMaxParams of them, and
+// stores them in values at the positions given by pending.
+func (s *SqliteDb) multiGetChunk(q sqliteQuerier, keys []any, pending map[string][]int, values [][]byte) error {
+	placeholders := strings.Repeat("?, ", len(keys)-1) + "?"
+	rows, err := q.Query(fmt.Sprintf(`SELECT key, value FROM %s WHERE key IN (%s);`, s.table.name, placeholders), keys...)
+	if err != nil {
+		return fmt.Errorf("failed to query rows: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key, value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if s.opts.decodeValue != nil {
+			if value, _, err = s.opts.decodeValue(value); err != nil {
+				return fmt.Errorf("failed to decode value: %w", err)
+			}
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		// Keys requested more than once get their own copy of the value.
+		for j, i := range pending[string(key)] {
+			if j > 0 {
+				value = cp(value)
+			}
+			values[i] = value
+		}
+	}
+	return rows.Err()
+}
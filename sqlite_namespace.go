@@ -0,0 +1,183 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// sqliteDefaultNamespace is the namespace of the state_storage table, which a
+// store returned by NewSqliteDb operates on.
+const sqliteDefaultNamespace = "state"
+
+var sqliteNamespaceName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// sqliteTable holds the statements operating on the table of a namespace.
+type sqliteTable struct {
+	name   string
+	create string
+	upsert string
+	// upgrade rewrites the value of a key only if it still holds the given one.
+	upgrade string
+	del     string
+	get     string
+	has     string
+}
+
+// newSqliteTable returns the statements of namespace, whose table is
+// state_storage_<namespace>, or state_storage for the default namespace.
+func newSqliteTable(namespace string) sqliteTable {
+	name, index := "state_storage", "idx_key"
+	if namespace != sqliteDefaultNamespace {
+		name += "_" + namespace
+		index += "_" + namespace
+	}
+	return sqliteTable{
+		name: name,
+		// Keys and values are arbitrary bytes: BLOB columns store them
+		// verbatim and compare them with memcmp, which orders keys like
+		// bytes.Compare.
+		create: fmt.Sprintf(`
+	CREATE TABLE IF NOT EXISTS %[1]s (
+		id integer not null primary key,
+		key BLOB not null,
+		value BLOB not null,
+		unique (key)
+	);
+
+	CREATE UNIQUE INDEX IF NOT EXISTS %[2]s ON %[1]s (key);
+	`, name, index),
+		upsert: fmt.Sprintf(`
+	INSERT INTO %s(key, value)
+    VALUES(?, ?)
+  ON CONFLICT(key) DO UPDATE SET
+    value = ?;
+	`, name),
+		upgrade: fmt.Sprintf(`UPDATE %s SET value = ? WHERE key = ? AND value = ?;`, name),
+		del:     fmt.Sprintf(`DELETE FROM %s WHERE key = ?;`, name),
+		get: fmt.Sprintf(`
+	SELECT value FROM %s
+	WHERE key = ?
+	LIMIT 1;
+	`, name),
+		// EXISTS is answered from the key index alone, without reading
+		// the value, and always returns a single row.
+		has: fmt.Sprintf(`SELECT EXISTS(SELECT 1 FROM %s WHERE key = ?);`, name),
+	}
+}
+
+// upsertRows returns the statement setting the values of n keys, given as n
+// key and value argument pairs. A key appearing in several pairs ends up with
+// the value of the last one, as the rows are inserted in order.
+func (t sqliteTable) upsertRows(n int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "INSERT INTO %s(key, value) VALUES ", t.name)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString("(?, ?)")
+	}
+	b.WriteString(" ON CONFLICT(key) DO UPDATE SET value = excluded.value;")
+	return b.String()
+}
+
+// exists reports whether the table has been created in the database of q.
+func (t sqliteTable) exists(q sqliteQuerier) (bool, error) {
+	var n int
+	err := q.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = ?;`, t.name).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to query table %s: %w", t.name, err)
+	}
+	return n > 0, nil
+}
+
+// open creates the table with db if create is set, and prepares the point
+// lookups of Get and Has on reads.
+func (t sqliteTable) open(db, reads *sql.DB, create bool) (get, has *sql.Stmt, err error) {
+	if create {
+		if _, err := db.Exec(t.create); err != nil {
+			return nil, nil, fmt.Errorf("failed to exec SQL statement: %w", err)
+		}
+	}
+	get, err = reads.Prepare(t.get)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare SQL statement: %w", err)
+	}
+	has, err = reads.Prepare(t.has)
+	if err != nil {
+		_ = get.Close()
+		return nil, nil, fmt.Errorf("failed to prepare SQL statement: %w", err)
+	}
+	return get, has, nil
+}
+
+// Namespace returns a store for the keyspace name, kept in its own table of
+// the same database file and created if needed: its keys are independent from
+// those of every other namespace. The store returned by NewSqliteDb is the
+// "state" namespace. A namespace store shares the connections and the
+// auto-commit transaction of the store it was obtained from; closing it only
+// releases its own iterators, snapshots and statements, and closing the original store
+// closes its namespace stores too. Creating a namespace commits the buffered
+// auto-commit writes first.
+func (s *SqliteDb) Namespace(name string) (*SqliteDb, error) {
+	if !sqliteNamespaceName.MatchString(name) {
+		return nil, fmt.Errorf("invalid namespace %q: only lowercase letters, digits and underscores are allowed", name)
+	}
+	root := s.file()
+	table := newSqliteTable(name)
+	exists, err := table.exists(root.reads)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open namespace %q: %w", name, err)
+	}
+	var get, has *sql.Stmt
+	open := func() (err error) {
+		get, has, err = table.open(root.db, root.reads, !exists && !root.opts.readOnly)
+		return err
+	}
+	if !exists && !root.opts.readOnly {
+		// Creating the table needs the write lock, which an open auto-commit
+		// transaction holds until its next commit.
+		err = root.flushed(open)
+	} else {
+		err = open()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open namespace %q: %w", name, err)
+	}
+
+	root.nsMtx.Lock()
+	defer root.nsMtx.Unlock()
+	storeID, ok := root.nsStoreIDs[name]
+	if !ok {
+		// Stores of the same namespace share their read cache entries.
+		storeID = sqliteStoreIDs.Add(1)
+		root.nsStoreIDs[name] = storeID
+	}
+	ns := &SqliteDb{
+		db:        root.db,
+		reads:     root.reads,
+		opts:      root.opts,
+		table:     table,
+		path:      root.path,
+		getStmt:   get,
+		hasStmt:   has,
+		ac:        root.ac,
+		storeID:   storeID,
+		iterators: make(map[*sqliteIterator]struct{}),
+		snapshots: make(map[*sqliteSnapshot]struct{}),
+		root:      root,
+	}
+	root.namespaces[ns] = struct{}{}
+	return ns, nil
+}
+
+// file returns the store that opened the database file, which owns the
+// connections, as opposed to a namespace store.
+func (s *SqliteDb) file() *SqliteDb {
+	if s.root != nil {
+		return s.root
+	}
+	return s
+}
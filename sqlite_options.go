@@ -0,0 +1,297 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+// ValueEncoder converts a value into the representation stored in the database,
+// for example by prefixing it with a format version.
+type ValueEncoder func(value []byte) ([]byte, error)
+
+// ValueDecoder converts a stored representation back into the value that was
+// set. It reports upgrade when the stored representation uses an outdated
+// format, in which case Get rewrites the entry with the current ValueEncoder.
+type ValueDecoder func(stored []byte) (value []byte, upgrade bool, err error)
+
+// Observer is called after each operation of a store with the name of the
+// operation, the time it took, the size in bytes of its key and value, and
+// the error it returned. The operations are "get", "set" and "delete", each
+// of them sync or not, "iterate" for the creation of an iterator, with zero
+// sizes, and "batch_write", whose sizes add up those of the batched keys and
+// values. It is called synchronously, so it must be fast and safe for
+// concurrent use.
+//
+// In auto-commit mode, each commit of the buffered writes is also reported as
+// "autocommit", with the sizes of the keys and values it commits. If it fails,
+// those writes are lost although the calls that made them succeeded.
+type Observer func(op string, d time.Duration, keySize, valueSize int, err error)
+
+const (
+	defaultSqliteJournalMode = "WAL"
+	defaultSqliteBusyTimeout = 5000
+	// SQLite runs one writer at a time, and WAL readers gain little from more
+	// connections than cores, so a handful of them is kept open and idle.
+	defaultSqliteMaxOpenConns = 8
+	defaultSqliteMaxIdleConns = 8
+)
+
+var (
+	sqliteJournalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	sqliteSyncModes    = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+// sqliteOptions holds the SqliteDb settings parsed from the generic Options.
+type sqliteOptions struct {
+	// journalMode, synchronous and busyTimeout (in milliseconds) are applied
+	// to every connection with the corresponding PRAGMA. An empty synchronous
+	// keeps the default of the go-sqlite3 driver, which opens connections with
+	// synchronous=NORMAL rather than the FULL of SQLite itself.
+	journalMode string
+	synchronous string
+	busyTimeout int
+
+	// busyAttempts and busyRetryDelay bound the retries of writes failing with
+	// SQLITE_BUSY or SQLITE_LOCKED; see retryBusy.
+	busyAttempts   int
+	busyRetryDelay time.Duration
+
+	// encryptionKey, if set, encrypts the database file with SQLCipher.
+	encryptionKey string
+
+	// maxOpenConns, maxIdleConns and connMaxLifetime configure the
+	// database/sql connection pool.
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+
+	// readOnly opens the database file read-only: the store rejects writes.
+	readOnly bool
+
+	// separateReadWrite runs writes on a single dedicated connection and
+	// reads on a separate pool of read-only connections.
+	separateReadWrite bool
+
+	// migrateSchema migrates the tables of a database created by an older
+	// version to the current schema on open, instead of refusing to open it.
+	migrateSchema bool
+
+	// inMemory keeps the database in memory instead of in a file under dir.
+	inMemory bool
+
+	// autoCommitInterval and autoCommitOps enable auto-commit mode when either
+	// is positive: Set and Delete accumulate in one open transaction that is
+	// committed every interval or every autoCommitOps operations.
+	autoCommitInterval time.Duration
+	autoCommitOps      int
+
+	// encodeValue and decodeValue transform values on their way into and out
+	// of the database. Values pass through unchanged when they are nil.
+	encodeValue ValueEncoder
+	decodeValue ValueDecoder
+
+	// observer, if set, is called after each operation; see Observer.
+	observer Observer
+
+	// readCache, if set, caches the values returned by Get. It may be shared
+	// with other stores, and only sees the writes made through them.
+	readCache *ReadCache
+}
+
+// parseSqliteOptions reads the SqliteDb settings from opts, which may be nil.
+// Recognized keys:
+//
+//	journal_mode         string    DELETE, TRUNCATE, PERSIST, MEMORY, WAL (default) or OFF
+//	synchronous          string    OFF, NORMAL, FULL or EXTRA; default NORMAL, set by the driver
+//	busy_timeout         int       milliseconds to wait on a locked database, default 5000
+//	busy_attempts        int       attempts at a write failing with SQLITE_BUSY or SQLITE_LOCKED, default 5
+//	busy_retry_delay     duration  delay before the first retry, doubled for each one, default 10ms
+//	encryption_key       string    SQLCipher key of the database; requires a SQLCipher build
+//	in_memory            bool      keep the database in memory, nothing is written to dir
+//	read_only            bool      open an existing database read-only; writes fail with errReadOnly
+//	separate_read_write  bool      write on a single dedicated connection, read on a read-only pool
+//	migrate_schema       bool      migrate the tables of an older schema on open; back up the file first
+//	max_open_conns       int       maximum number of open connections, default 8; 0 means unlimited
+//	max_idle_conns       int       maximum number of idle connections, default 8
+//	conn_max_lifetime    duration  maximum time a connection is reused, default 0 (forever)
+//	autocommit_interval  duration  commit buffered writes at this interval
+//	autocommit_ops       int       commit buffered writes after this many operations
+//	encode_value         ValueEncoder  applied to values before they are stored
+//	decode_value         ValueDecoder  applied to stored values before they are returned
+//	read_cache           *ReadCache    cache for Get, possibly shared with other stores; writes
+//	                                   from stores without it or other processes leave it stale
+//	observer             Observer      called after each operation, to collect metrics
+//
+// Unlike those of database/sql, the pool defaults are bounded, since SQLite
+// serializes writers and extra connections only add lock contention and open
+// files. Every open iterator or snapshot holds a connection, so a low
+// max_open_conns makes callers wait for them to be closed, which deadlocks a
+// goroutine that still holds one. With in_memory the
+// pool is always a single connection that is kept forever, since the database
+// is dropped along with its last connection. Auto-commit mode holds a
+// connection for its open transaction, so it is rejected along with in_memory
+// or max_open_conns = 1.
+//
+// In auto-commit mode, Set and Delete return before their writes are
+// committed. A commit that fails, for example on a full disk, rolls back and
+// drops every write buffered since the previous one. The failure is reported
+// to the observer and returned by the call that triggered the commit, or else
+// by the next write, Flush or Close.
+//
+// With separate_read_write, writes queue for a single connection while reads,
+// iterators and snapshots use a second pool of read-only connections, which
+// the pool options configure. In WAL mode readers and the writer then never
+// wait for each other. In auto-commit mode the writer connection is held by
+// the open transaction until it commits.
+func parseSqliteOptions(opts Options) (sqliteOptions, error) {
+	o := sqliteOptions{
+		journalMode: defaultSqliteJournalMode,
+		busyTimeout: defaultSqliteBusyTimeout,
+
+		busyAttempts:   defaultSqliteBusyAttempts,
+		busyRetryDelay: defaultSqliteBusyRetryDelay,
+
+		maxOpenConns: defaultSqliteMaxOpenConns,
+		maxIdleConns: defaultSqliteMaxIdleConns,
+	}
+	if opts == nil {
+		return o, nil
+	}
+
+	var err error
+	if v := opts.Get("journal_mode"); v != nil {
+		if o.journalMode, err = parseSqlitePragmaValue("journal_mode", v, sqliteJournalModes); err != nil {
+			return o, err
+		}
+	}
+	if v := opts.Get("synchronous"); v != nil {
+		if o.synchronous, err = parseSqlitePragmaValue("synchronous", v, sqliteSyncModes); err != nil {
+			return o, err
+		}
+	}
+	if v := opts.Get("busy_timeout"); v != nil {
+		if o.busyTimeout, err = cast.ToIntE(v); err != nil || o.busyTimeout < 0 {
+			return o, fmt.Errorf("invalid busy_timeout %v: must be a non-negative number of milliseconds", v)
+		}
+	}
+
+	if v := opts.Get("busy_attempts"); v != nil {
+		if o.busyAttempts, err = cast.ToIntE(v); err != nil || o.busyAttempts < 1 {
+			return o, fmt.Errorf("invalid busy_attempts %v: must be a positive number", v)
+		}
+	}
+	if v := opts.Get("busy_retry_delay"); v != nil {
+		if o.busyRetryDelay, err = cast.ToDurationE(v); err != nil || o.busyRetryDelay < 0 {
+			return o, fmt.Errorf("invalid busy_retry_delay %v: must be a non-negative duration", v)
+		}
+	}
+
+	o.encryptionKey = cast.ToString(opts.Get("encryption_key"))
+	o.inMemory = cast.ToBool(opts.Get("in_memory"))
+	o.readOnly = cast.ToBool(opts.Get("read_only"))
+	o.migrateSchema = cast.ToBool(opts.Get("migrate_schema"))
+	o.separateReadWrite = cast.ToBool(opts.Get("separate_read_write"))
+	if o.inMemory && o.readOnly {
+		return o, errors.New("in_memory and read_only options are mutually exclusive")
+	}
+	if o.separateReadWrite && (o.inMemory || o.readOnly) {
+		return o, errors.New("separate_read_write option requires a writable database file")
+	}
+	for _, pool := range []struct {
+		key   string
+		value *int
+	}{
+		{"max_open_conns", &o.maxOpenConns},
+		{"max_idle_conns", &o.maxIdleConns},
+	} {
+		if v := opts.Get(pool.key); v != nil {
+			if *pool.value, err = cast.ToIntE(v); err != nil || *pool.value < 0 {
+				return o, fmt.Errorf("invalid %s %v: must be a non-negative number", pool.key, v)
+			}
+		}
+	}
+	if v := opts.Get("conn_max_lifetime"); v != nil {
+		if o.connMaxLifetime, err = cast.ToDurationE(v); err != nil || o.connMaxLifetime < 0 {
+			return o, fmt.Errorf("invalid conn_max_lifetime %v: must be a non-negative duration", v)
+		}
+	}
+	if o.inMemory {
+		o.maxOpenConns, o.maxIdleConns, o.connMaxLifetime = 1, 1, 0
+	}
+	o.autoCommitInterval = cast.ToDuration(opts.Get("autocommit_interval"))
+	o.autoCommitOps = cast.ToInt(opts.Get("autocommit_ops"))
+	if (o.autoCommitInterval > 0 || o.autoCommitOps > 0) && !o.readOnly && o.maxOpenConns == 1 {
+		// The open auto-commit transaction holds a connection, which reads
+		// missing the write buffer would wait for until the next commit.
+		return o, errors.New("autocommit_interval and autocommit_ops need more than one connection: " +
+			"they cannot be combined with in_memory or max_open_conns = 1")
+	}
+
+	switch fn := opts.Get("encode_value").(type) {
+	case nil:
+	case ValueEncoder:
+		o.encodeValue = fn
+	case func([]byte) ([]byte, error):
+		o.encodeValue = fn
+	default:
+		return o, fmt.Errorf("invalid encode_value option of type %T", fn)
+	}
+	switch fn := opts.Get("decode_value").(type) {
+	case nil:
+	case ValueDecoder:
+		o.decodeValue = fn
+	case func([]byte) ([]byte, bool, error):
+		o.decodeValue = fn
+	default:
+		return o, fmt.Errorf("invalid decode_value option of type %T", fn)
+	}
+	switch fn := opts.Get("observer").(type) {
+	case nil:
+	case Observer:
+		o.observer = fn
+	case func(string, time.Duration, int, int, error):
+		o.observer = fn
+	default:
+		return o, fmt.Errorf("invalid observer option of type %T", fn)
+	}
+	switch c := opts.Get("read_cache").(type) {
+	case nil:
+	case *ReadCache:
+		o.readCache = c
+	default:
+		return o, fmt.Errorf("invalid read_cache option of type %T", c)
+	}
+
+	return o, nil
+}
+
+// parseSqlitePragmaValue returns v, upper-cased, if it is one of allowed.
+func parseSqlitePragmaValue(name string, v interface{}, allowed []string) (string, error) {
+	value := strings.ToUpper(cast.ToString(v))
+	for _, a := range allowed {
+		if value == a {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("invalid %s %q: expected one of %s", name, v, strings.Join(allowed, ", "))
+}
+
+// pragmas returns the PRAGMA statements that configure each connection.
+func (o sqliteOptions) pragmas() []string {
+	pragmas := []string{
+		fmt.Sprintf("PRAGMA busy_timeout = %d;", o.busyTimeout),
+	}
+	if !o.readOnly {
+		// The journal mode is recorded in the database file, so a read-only
+		// connection uses the one set by the writer.
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA journal_mode = %s;", o.journalMode))
+	}
+	if o.synchronous != "" {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA synchronous = %s;", o.synchronous))
+	}
+	return pragmas
+}
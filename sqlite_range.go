@@ -0,0 +1,196 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// rangeClause returns a WHERE clause and its arguments selecting the keys in
+// [start, end), where a nil start or end leaves that side unbounded.
+func rangeClause(start, end []byte) (string, []any) {
+	var (
+		keyClause = []string{}
+		queryArgs = []any{}
+	)
+	if start != nil {
+		keyClause = append(keyClause, "key >= ?")
+		queryArgs = append(queryArgs, start)
+	}
+	if end != nil {
+		keyClause = append(keyClause, "key < ?")
+		queryArgs = append(queryArgs, end)
+	}
+	if len(keyClause) == 0 {
+		return "1=1", queryArgs
+	}
+	return strings.Join(keyClause, " AND "), queryArgs
+}
+
+// CountRange returns the number of keys in [start, end). Nil bounds are
+// unbounded, as with Iterator.
+func (s *SqliteDb) CountRange(start, end []byte) (int64, error) {
+	if !isValidDomain(start, end) {
+		return 0, errKeyEmpty
+	}
+
+	var count int64
+	err := s.read(func(q sqliteQuerier) (err error) {
+		count, err = s.countRange(q, start, end)
+		return err
+	})
+	return count, err
+}
+
+func (s *SqliteDb) countRange(q sqliteQuerier, start, end []byte) (int64, error) {
+	whereClause, queryArgs := rangeClause(start, end)
+	cmd := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s;`, s.table.name, whereClause)
+
+	var count int64
+	if err := q.QueryRow(cmd, queryArgs...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count keys: %w", err)
+	}
+	return count, nil
+}
+
+// Count returns the number of keys in the store. It scans the key index, so
+// it takes time proportional to the size of the store.
+func (s *SqliteDb) Count() (int64, error) {
+	count, err := s.CountRange(nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	s.countMtx.Lock()
+	s.count, s.countAt = count, time.Now()
+	s.countMtx.Unlock()
+	return count, nil
+}
+
+// cachedCount returns the result of the latest Count if it is more recent
+// than maxAge, and otherwise counts the keys again.
+func (s *SqliteDb) cachedCount(maxAge time.Duration) (int64, error) {
+	s.countMtx.Lock()
+	count, countAt := s.count, s.countAt
+	s.countMtx.Unlock()
+	if !countAt.IsZero() && time.Since(countAt) < maxAge {
+		return count, nil
+	}
+	return s.Count()
+}
+
+// DeleteRange deletes the keys in [start, end) with a single statement. Nil
+// bounds are unbounded, as with Iterator, so DeleteRange(nil, nil) empties the
+// store. Buffered auto-commit writes are committed first.
+func (s *SqliteDb) DeleteRange(start, end []byte) error {
+	if s.opts.readOnly {
+		return errReadOnly
+	}
+	if !isValidDomain(start, end) {
+		return errKeyEmpty
+	}
+	if s.opts.readCache != nil {
+		defer s.opts.readCache.invalidateRange(s.storeID, start, end)
+	}
+
+	whereClause, queryArgs := rangeClause(start, end)
+	cmd := fmt.Sprintf(`DELETE FROM %s WHERE %s;`, s.table.name, whereClause)
+	err := s.flushed(func() error {
+		return s.opts.retryBusy(context.Background(), func() error {
+			_, err := s.db.Exec(cmd, queryArgs...)
+			return err
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete range: %w", err)
+	}
+	return nil
+}
+
+// KeyAtRank returns the key at zero-based position rank among the keys in
+// [start, end) in ascending order, or nil if the range holds fewer keys.
+func (s *SqliteDb) KeyAtRank(start, end []byte, rank int64) ([]byte, error) {
+	if !isValidDomain(start, end) {
+		return nil, errKeyEmpty
+	}
+	if rank < 0 {
+		return nil, fmt.Errorf("invalid rank %d: must not be negative", rank)
+	}
+
+	var key []byte
+	err := s.read(func(q sqliteQuerier) (err error) {
+		key, err = s.keyAtRank(q, start, end, rank)
+		return err
+	})
+	return key, err
+}
+
+func (s *SqliteDb) keyAtRank(q sqliteQuerier, start, end []byte, rank int64) ([]byte, error) {
+	whereClause, queryArgs := rangeClause(start, end)
+	cmd := fmt.Sprintf(`
+	SELECT key FROM %s
+	WHERE %s
+	ORDER BY key ASC
+	LIMIT 1 OFFSET ?;
+	`, s.table.name, whereClause)
+
+	var key []byte
+	if err := q.QueryRow(cmd, append(queryArgs, rank)...).Scan(&key); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query key at rank %d: %w", rank, err)
+	}
+	return key, nil
+}
+
+// SearchFirst returns the first key in [start, end) for which pred returns
+// true, or nil if there is none. pred must be monotonic over the range: once
+// it returns true for a key it must return true for every greater key.
+//
+// The search is a binary search over key ranks, so pred is called O(log n)
+// times, but each probe skips over the keys below its rank, so the search
+// still reads O(n) index entries. Buffered auto-commit writes are committed
+// first, and the count and the probes all run in one read transaction, so
+// concurrent writes cannot shift the ranks during the search. The transaction
+// holds a connection until the search ends, so with in_memory or
+// max_open_conns = 1 pred must not use the store.
+func (s *SqliteDb) SearchFirst(start, end []byte, pred func(key []byte) bool) ([]byte, error) {
+	if !isValidDomain(start, end) {
+		return nil, errKeyEmpty
+	}
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	tx, err := s.reads.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin read transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	n, err := s.countRange(tx, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		lo, hi = int64(0), n
+		found  []byte
+	)
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		key, err := s.keyAtRank(tx, start, end, mid)
+		if err != nil {
+			return nil, err
+		}
+		if pred(key) {
+			found = key
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return found, nil
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	defaultSqliteBusyAttempts   = 5
+	defaultSqliteBusyRetryDelay = 10 * time.Millisecond
+	// maxSqliteBusyRetryDelay caps the exponential backoff between attempts.
+	maxSqliteBusyRetryDelay = time.Second
+)
+
+// isSqliteBusy reports whether err is a transient SQLITE_BUSY or SQLITE_LOCKED
+// error, which may go away once the connection holding the lock is done.
+func isSqliteBusy(err error) bool {
+	var serr sqlite3.Error
+	if !errors.As(err, &serr) {
+		return false
+	}
+	return serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked
+}
+
+// retryBusy runs fn until it succeeds, fails with an error other than
+// SQLITE_BUSY or SQLITE_LOCKED, or the configured number of attempts is used
+// up, doubling the delay between attempts. fn must be safe to run again after a
+// busy error: a whole transaction, never a statement within one.
+func (o sqliteOptions) retryBusy(ctx context.Context, fn func() error) error {
+	delay := o.busyRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= o.busyAttempts || !isSqliteBusy(err) {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		if delay *= 2; delay > maxSqliteBusyRetryDelay {
+			delay = maxSqliteBusyRetryDelay
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// sqliteSchemaVersion is the version of the tables of SqliteDb, recorded in
+// the schema_version table of the database file:
+//
+//	0  key and value columns declared varchar, no schema_version table
+//	1  key and value columns declared BLOB, so that keys sort bytewise
+const sqliteSchemaVersion = 1
+
+// errSqliteSchemaOutdated is returned when opening a database whose tables use
+// an older schema without the migrate_schema option.
+var errSqliteSchemaOutdated = errors.New("database schema is outdated")
+
+// migrateSqliteSchema brings the tables of db to sqliteSchemaVersion and
+// records it. If migrate is not set, an outdated database is left untouched
+// and errSqliteSchemaOutdated is returned instead. Everything happens in a
+// single transaction, so a crash leaves the database as it was, and a
+// migrated database is not migrated again.
+//
+// The version is checked in a read transaction first, and the write lock only
+// taken if the database must be migrated or its version recorded, so that
+// opening an up-to-date database does not wait for other writers.
+func migrateSqliteSchema(db *sql.DB, migrate bool) error {
+	tx, err := db.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("failed to begin read transaction: %w", err)
+	}
+	version, recorded, outdated, err := sqliteSchemaVersionOf(tx)
+	_ = tx.Rollback()
+	if err != nil {
+		return err
+	}
+	if current, err := checkSqliteSchemaVersion(version, recorded, outdated, migrate); current || err != nil {
+		return err
+	}
+
+	return withSqliteImmediateTx(db, func(tx sqliteImmediateTx) error {
+		ctx := context.Background()
+		if _, err := tx.conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (version integer not null);`); err != nil {
+			return fmt.Errorf("failed to create schema_version table: %w", err)
+		}
+		// Another handle may have migrated the database in the meantime.
+		version, recorded, outdated, err := sqliteSchemaVersionOf(tx)
+		if err != nil {
+			return err
+		}
+		if current, err := checkSqliteSchemaVersion(version, recorded, outdated, migrate); current || err != nil {
+			return err
+		}
+
+		for _, name := range outdated {
+			if err := migrateSqliteTableToBlob(tx, name); err != nil {
+				return fmt.Errorf("failed to migrate table %s: %w", name, err)
+			}
+		}
+		if _, err := tx.conn.ExecContext(ctx, `DELETE FROM schema_version;`); err != nil {
+			return fmt.Errorf("failed to record schema version: %w", err)
+		}
+		if _, err := tx.conn.ExecContext(ctx, `INSERT INTO schema_version (version) VALUES (?);`, sqliteSchemaVersion); err != nil {
+			return fmt.Errorf("failed to record schema version: %w", err)
+		}
+		return nil
+	})
+}
+
+// checkSqliteSchemaVersion reports whether a database whose schema is
+// described by the results of sqliteSchemaVersionOf is current, or else
+// returns an error if it cannot be migrated.
+func checkSqliteSchemaVersion(version int, recorded bool, outdated []string, migrate bool) (current bool, err error) {
+	if version > sqliteSchemaVersion {
+		return false, fmt.Errorf("database schema version %d is newer than the supported version %d", version, sqliteSchemaVersion)
+	}
+	if recorded && version == sqliteSchemaVersion {
+		return true, nil
+	}
+	if len(outdated) > 0 && !migrate {
+		return false, fmt.Errorf(
+			"%w: version %d, expected %d; back up the database and open it with the migrate_schema option to migrate it",
+			errSqliteSchemaOutdated, version, sqliteSchemaVersion,
+		)
+	}
+	return false, nil
+}
+
+// checkSqliteSchema returns errSqliteSchemaOutdated if the tables of db, which
+// cannot be migrated, use an older schema.
+func checkSqliteSchema(db *sql.DB) error {
+	version, _, _, err := sqliteSchemaVersionOf(db)
+	if err != nil {
+		return err
+	}
+	if version != sqliteSchemaVersion {
+		return fmt.Errorf("%w: version %d, expected %d", errSqliteSchemaOutdated, version, sqliteSchemaVersion)
+	}
+	return nil
+}
+
+// sqliteSchemaVersionOf returns the schema version recorded in q, if recorded
+// is set, or else infers it from the tables, which are older than the version
+// table if their key column is not a BLOB. It also returns such tables.
+func sqliteSchemaVersionOf(q sqliteQuerier) (version int, recorded bool, outdated []string, err error) {
+	var n int
+	err = q.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version';`).Scan(&n)
+	if err != nil {
+		return 0, false, nil, fmt.Errorf("failed to query schema version: %w", err)
+	}
+	if n > 0 {
+		err = q.QueryRow(`SELECT version FROM schema_version LIMIT 1;`).Scan(&version)
+		switch {
+		case err == nil:
+			return version, true, nil, nil
+		case !errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil, fmt.Errorf("failed to query schema version: %w", err)
+		}
+	}
+
+	rows, err := q.Query(`
+	SELECT m.name FROM sqlite_master AS m, pragma_table_info(m.name) AS c
+	WHERE m.type = 'table' AND m.name LIKE 'state\_storage%' ESCAPE '\'
+		AND c.name = 'key' AND upper(c.type) != 'BLOB'
+	ORDER BY m.name;
+	`)
+	if err != nil {
+		return 0, false, nil, fmt.Errorf("failed to query table columns: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return 0, false, nil, fmt.Errorf("failed to scan table name: %w", err)
+		}
+		outdated = append(outdated, name)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, false, nil, fmt.Errorf("failed to query table columns: %w", err)
+	}
+	if len(outdated) > 0 {
+		return 0, false, outdated, nil
+	}
+	// A new database, or one created before versions were recorded.
+	return sqliteSchemaVersion, false, nil, nil
+}
+
+// migrateSqliteTableToBlob copies the entries of the table name into a new
+// table with BLOB columns, which then replaces it along with its index.
+func migrateSqliteTableToBlob(tx sqliteImmediateTx, name string) error {
+	namespace := sqliteDefaultNamespace
+	if name != "state_storage" {
+		namespace = strings.TrimPrefix(name, "state_storage_")
+	}
+	table := newSqliteTable(namespace)
+	tmp := newSqliteTable(namespace + "_migrating")
+
+	ctx := context.Background()
+	for _, stmt := range []string{
+		tmp.create,
+		// Values stored as TEXT become the BLOB of their bytes, which is
+		// what they were set to.
+		fmt.Sprintf(`
+		INSERT INTO %s (id, key, value)
+		SELECT id, CAST(key AS BLOB), CAST(value AS BLOB) FROM %s;
+		`, tmp.name, name),
+		fmt.Sprintf(`DROP TABLE %s;`, name),
+		fmt.Sprintf(`DROP INDEX IF EXISTS idx_key_%s_migrating;`, namespace),
+		fmt.Sprintf(`ALTER TABLE %s RENAME TO %s;`, tmp.name, table.name),
+		table.create,
+	} {
+		if _, err := tx.conn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	// errSnapshotClosed is returned when a closed snapshot is used.
+	errSnapshotClosed = errors.New("snapshot has been closed")
+
+	// errSnapshotSingleConn is returned by NewSnapshot when the store reads
+	// from a single connection, which the snapshot would hold until closed.
+	errSnapshotSingleConn = errors.New("snapshots need more than one connection: " +
+		"they are not supported with in_memory or max_open_conns = 1")
+)
+
+var _ Snapshot = (*sqliteSnapshot)(nil)
+
+// sqliteSnapshot reads from a read transaction that is kept open until Close.
+// In WAL mode a read transaction observes the database as of its first read
+// without blocking writers, so it stays consistent while other handles write.
+type sqliteSnapshot struct {
+	db *SqliteDb
+	tx *sql.Tx
+
+	mtx       sync.Mutex
+	iterators map[*sqliteIterator]struct{}
+	closed    bool
+}
+
+// NewSnapshot returns a point-in-time view of the store, for reads that must
+// be consistent with one another, such as hashing the whole keyspace. Buffered
+// auto-commit writes are committed first so that the snapshot includes them.
+//
+// The snapshot holds a connection and a read transaction until it is closed.
+// In WAL mode, the default, writers are not blocked meanwhile, but the WAL
+// cannot be checkpointed past the snapshot, so it should not be kept open for
+// long. In other journal modes, writers wait for the snapshot to be closed.
+//
+// Since every other call would wait for the snapshot to be closed, it fails
+// with in_memory or max_open_conns = 1, where the pool has a single connection.
+func (s *SqliteDb) NewSnapshot() (Snapshot, error) {
+	if s.reads.Stats().MaxOpenConnections == 1 {
+		return nil, errSnapshotSingleConn
+	}
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+	tx, err := s.reads.BeginTx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin read transaction: %w", err)
+	}
+	// SQLite only starts the read transaction, and so takes the snapshot, on
+	// the first read.
+	var n int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM sqlite_master;`).Scan(&n); err != nil {
+		_ = tx.Rollback()
+		return nil, fmt.Errorf("failed to start read transaction: %w", err)
+	}
+
+	snap := &sqliteSnapshot{
+		db:        s,
+		tx:        tx,
+		iterators: make(map[*sqliteIterator]struct{}),
+	}
+	s.itrMtx.Lock()
+	s.snapshots[snap] = struct{}{}
+	s.itrMtx.Unlock()
+	return snap, nil
+}
+
+// Get implements Snapshot.
+func (snap *sqliteSnapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errKeyEmpty
+	}
+	if err := snap.checkOpen(); err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	ctx := context.Background()
+	err := snap.db.queryStmt(ctx, snap.tx, snap.db.getStmt, snap.db.table.get, key).Scan(&value)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to query row: %w", err)
+	}
+	if snap.db.opts.decodeValue != nil {
+		// Outdated formats are not upgraded: the snapshot is read-only.
+		decoded, _, err := snap.db.opts.decodeValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode value: %w", err)
+		}
+		value = decoded
+	}
+	if value == nil {
+		// The key exists, with an empty value.
+		value = []byte{}
+	}
+	return value, nil
+}
+
+// Has implements Snapshot.
+func (snap *sqliteSnapshot) Has(key []byte) (bool, error) {
+	if len(key) == 0 {
+		return false, errKeyEmpty
+	}
+	if err := snap.checkOpen(); err != nil {
+		return false, err
+	}
+
+	var exists bool
+	ctx := context.Background()
+	err := snap.db.queryStmt(ctx, snap.tx, snap.db.hasStmt, snap.db.table.has, key).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to query row: %w", err)
+	}
+	return exists, nil
+}
+
+// Iterator implements Snapshot.
+func (snap *sqliteSnapshot) Iterator(start, end []byte) (Iterator, error) {
+	return snap.newIterator(start, end, false)
+}
+
+// ReverseIterator implements Snapshot.
+func (snap *sqliteSnapshot) ReverseIterator(start, end []byte) (Iterator, error) {
+	return snap.newIterator(start, end, true)
+}
+
+func (snap *sqliteSnapshot) newIterator(start, end []byte, reverse bool) (Iterator, error) {
+	if !isValidDomain(start, end) {
+		return nil, errKeyEmpty
+	}
+	if err := snap.checkOpen(); err != nil {
+		return nil, err
+	}
+	return newSqliteIterator(context.Background(), nil, snap.db, snap, start, end, reverse, 0)
+}
+
+// checkOpen returns errSnapshotClosed once the snapshot is closed.
+func (snap *sqliteSnapshot) checkOpen() error {
+	snap.mtx.Lock()
+	defer snap.mtx.Unlock()
+	if snap.closed {
+		return errSnapshotClosed
+	}
+	return nil
+}
+
+// Close implements Snapshot. It closes the open iterators of the snapshot, then
+// ends its read transaction.
+func (snap *sqliteSnapshot) Close() error {
+	snap.mtx.Lock()
+	if snap.closed {
+		snap.mtx.Unlock()
+		return nil
+	}
+	snap.closed = true
+	iterators := make([]*sqliteIterator, 0, len(snap.iterators))
+	for itr := range snap.iterators {
+		iterators = append(iterators, itr)
+	}
+	snap.mtx.Unlock()
+
+	var err error
+	for _, itr := range iterators {
+		if cerr := itr.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if rerr := snap.tx.Rollback(); err == nil && !errors.Is(rerr, sql.ErrTxDone) {
+		err = rerr
+	}
+	snap.db.itrMtx.Lock()
+	delete(snap.db.snapshots, snap)
+	snap.db.itrMtx.Unlock()
+	return err
+}
@@ -0,0 +1,34 @@
+//go:build sqlcipher
+// +build sqlcipher
+
+// These tests need go-sqlite3 linked against SQLCipher, for example with
+// go test -tags sqlcipher,libsqlite3 and CGO_CFLAGS/CGO_LDFLAGS pointing at a
+// SQLCipher build installed as libsqlite3.
+
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSqliteEncryptionKey(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"encryption_key": "it's a secret"})
+	require.NoError(t, err)
+	require.NoError(t, db.Set([]byte("a"), []byte{1}))
+	require.NoError(t, db.Close())
+
+	db, err = NewSqliteDb("testdb", dir, OptionsMap{"encryption_key": "it's a secret"})
+	require.NoError(t, err)
+	value, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, value)
+	require.NoError(t, db.Close())
+
+	_, err = NewSqliteDb("testdb", dir, OptionsMap{"encryption_key": "wrong"})
+	require.ErrorIs(t, err, errSqliteWrongKey)
+	_, err = NewSqliteDb("testdb", dir, nil)
+	require.ErrorIs(t, err, errSqliteWrongKey)
+}
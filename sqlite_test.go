@@ -1,12 +1,33 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
+func newTestSqliteDb(t *testing.T, opts Options) *SqliteDb {
+	t.Helper()
+	db, err := NewSqliteDb("testdb", t.TempDir(), opts)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	return db
+}
+
 func TestDb(t *testing.T) {
 	name := fmt.Sprintf("test_%x", randStr(12))
 	defer cleanupDBDir("", name)
@@ -16,6 +37,7 @@ func TestDb(t *testing.T) {
 	// }()
 	db, err := NewSqliteDb(name, "", nil)
 	require.NoError(t, err)
+	defer db.Close()
 
 	// Set
 	err = db.Set([]byte{1, 2, 4}, []byte{1, 1, 1})
@@ -43,3 +65,2331 @@ func TestDb(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, []byte{2, 2, 2}, value)
 }
+
+func TestSqliteReadsSeeCommittedBatch(t *testing.T) {
+	// Reads run on any pooled connection, whichever one wrote the batch.
+	db := newTestSqliteDb(t, nil)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			key := []byte(fmt.Sprintf("key-%d", w))
+			for i := 0; i < 25; i++ {
+				value := []byte(fmt.Sprintf("value-%d-%d", w, i))
+				batch := db.NewBatch()
+				if !assert.NoError(t, batch.Set(key, value)) {
+					return
+				}
+				if !assert.NoError(t, batch.Write()) {
+					return
+				}
+				assert.NoError(t, batch.Close())
+
+				got, err := db.Get(key)
+				assert.NoError(t, err)
+				assert.Equal(t, value, got)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestSqliteToMap(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+
+	expect := map[string][]byte{
+		"a": {1},
+		"b": {2},
+		"c": {3},
+		"d": {4},
+	}
+	for k, v := range expect {
+		require.NoError(t, db.Set([]byte(k), v))
+	}
+
+	entries, err := db.ToMap(nil, nil, len(expect))
+	require.NoError(t, err)
+	require.Equal(t, expect, entries)
+
+	entries, err = db.ToMap([]byte("b"), []byte("d"), 10)
+	require.NoError(t, err)
+	require.Equal(t, map[string][]byte{"b": {2}, "c": {3}}, entries)
+
+	_, err = db.ToMap(nil, nil, len(expect)-1)
+	require.Error(t, err)
+
+	_, err = db.ToMap(nil, nil, 0)
+	require.Error(t, err)
+}
+
+func TestSqliteAutoCommit(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"autocommit_ops": 3})
+	require.NoError(t, err)
+	defer db.Close()
+	// A second handle on the same file only sees committed writes.
+	other, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer other.Close()
+
+	require.NoError(t, db.Set([]byte("a"), []byte{1}))
+	require.NoError(t, db.Set([]byte("b"), []byte{2}))
+
+	// Buffered writes are visible through the writing handle only.
+	checkValue(t, db, []byte("a"), []byte{1})
+	checkValue(t, other, []byte("a"), nil)
+
+	// The third operation reaches the threshold and commits.
+	require.NoError(t, db.Delete([]byte("b")))
+	checkValue(t, other, []byte("a"), []byte{1})
+	checkValue(t, other, []byte("b"), nil)
+
+	// Flush commits without reaching the threshold.
+	require.NoError(t, db.Set([]byte("c"), []byte{3}))
+	checkValue(t, other, []byte("c"), nil)
+	require.NoError(t, db.Flush())
+	checkValue(t, other, []byte("c"), []byte{3})
+}
+
+func TestSqliteAutoCommitInterval(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"autocommit_interval": 20 * time.Millisecond})
+	require.NoError(t, err)
+	other, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer other.Close()
+
+	require.NoError(t, db.Set([]byte("a"), []byte{1}))
+	checkValue(t, db, []byte("a"), []byte{1})
+	require.Eventually(t, func() bool {
+		value, err := other.Get([]byte("a"))
+		return err == nil && value != nil
+	}, time.Second, 5*time.Millisecond)
+
+	// Iterators observe buffered writes, and closing commits what is left.
+	require.NoError(t, db.Set([]byte("b"), []byte{2}))
+	assertKeyValues(t, db, map[string][]byte{"a": {1}, "b": {2}})
+	require.NoError(t, db.Set([]byte("c"), []byte{3}))
+	require.NoError(t, db.Close())
+
+	reopened, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer reopened.Close()
+	assertKeyValues(t, reopened, map[string][]byte{"a": {1}, "b": {2}, "c": {3}})
+	require.FileExists(t, filepath.Join(dir, "testdb"+DBFileSuffix))
+}
+
+func TestSqliteValueCodec(t *testing.T) {
+	const (
+		formatV1 = byte(1)
+		formatV2 = byte(2)
+	)
+	encode := func(value []byte) ([]byte, error) {
+		return append([]byte{formatV2}, value...), nil
+	}
+	decode := func(stored []byte) ([]byte, bool, error) {
+		if len(stored) == 0 {
+			return nil, false, errors.New("missing format version")
+		}
+		switch stored[0] {
+		case formatV1:
+			return stored[1:], true, nil
+		case formatV2:
+			return stored[1:], false, nil
+		default:
+			return nil, false, fmt.Errorf("unknown format version %d", stored[0])
+		}
+	}
+	db := newTestSqliteDb(t, OptionsMap{
+		"encode_value": ValueEncoder(encode),
+		"decode_value": ValueDecoder(decode),
+	})
+	stored := func(key []byte) []byte {
+		var value []byte
+		require.NoError(t, db.db.QueryRow(db.table.get, key).Scan(&value))
+		return value
+	}
+
+	require.NoError(t, db.Set([]byte("a"), []byte{0xa}))
+	require.Equal(t, []byte{formatV2, 0xa}, stored([]byte("a")))
+	checkValue(t, db, []byte("a"), []byte{0xa})
+
+	batch := db.NewBatch()
+	require.NoError(t, batch.Set([]byte("b"), []byte{0xb}))
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+	require.Equal(t, []byte{formatV2, 0xb}, stored([]byte("b")))
+
+	// An entry in the outdated format decodes transparently and is rewritten.
+	_, err := db.db.Exec(db.table.upsert, []byte("c"), []byte{formatV1, 0xc}, []byte{formatV1, 0xc})
+	require.NoError(t, err)
+	checkValue(t, db, []byte("c"), []byte{0xc})
+	require.Equal(t, []byte{formatV2, 0xc}, stored([]byte("c")))
+
+	assertKeyValues(t, db, map[string][]byte{"a": {0xa}, "b": {0xb}, "c": {0xc}})
+
+	// Undecodable entries surface as errors.
+	_, err = db.db.Exec(db.table.upsert, []byte("d"), []byte{9}, []byte{9})
+	require.NoError(t, err)
+	_, err = db.Get([]byte("d"))
+	require.Error(t, err)
+	itr, err := db.Iterator([]byte("d"), nil)
+	require.NoError(t, err)
+	require.False(t, itr.Valid())
+	require.Error(t, itr.Error())
+	require.NoError(t, itr.Close())
+}
+
+func TestSqliteValueCodecUpgradeRace(t *testing.T) {
+	encode := func(value []byte) ([]byte, error) { return append([]byte{2}, value...), nil }
+	decode := func(stored []byte) ([]byte, bool, error) { return stored[1:], stored[0] != 2, nil }
+	for name, extra := range map[string]OptionsMap{
+		"default":    nil,
+		"autocommit": {"autocommit_ops": 100},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var ops []string
+			opts := OptionsMap{
+				"encode_value": encode,
+				"decode_value": decode,
+				"observer": func(op string, _ time.Duration, _, _ int, _ error) {
+					ops = append(ops, op)
+				},
+			}
+			for k, v := range extra {
+				opts[k] = v
+			}
+			db := newTestSqliteDb(t, opts)
+			outdated := []byte{1, 0xa}
+			_, err := db.db.Exec(db.table.upsert, []byte("a"), outdated, outdated)
+			require.NoError(t, err)
+
+			// Get upgrades the entry without reporting a set.
+			checkValue(t, db, []byte("a"), []byte{0xa})
+			require.Equal(t, []string{"get"}, ops)
+			require.NoError(t, db.Flush())
+			var stored []byte
+			require.NoError(t, db.db.QueryRow(db.table.get, []byte("a")).Scan(&stored))
+			require.Equal(t, []byte{2, 0xa}, stored)
+
+			// A write between the read of the outdated entry and its rewrite
+			// wins over the rewrite.
+			_, err = db.db.Exec(db.table.upsert, []byte("b"), outdated, outdated)
+			require.NoError(t, err)
+			require.NoError(t, db.Set([]byte("b"), []byte{0xb}))
+			require.NoError(t, db.upgrade(context.Background(), []byte("b"), []byte{0xa}, outdated))
+			checkValue(t, db, []byte("b"), []byte{0xb})
+			require.NoError(t, db.Flush())
+			checkValue(t, db, []byte("b"), []byte{0xb})
+		})
+	}
+}
+
+func TestSqliteValueCodecInvalidOption(t *testing.T) {
+	_, err := NewSqliteDb("testdb", t.TempDir(), OptionsMap{"encode_value": "not a function"})
+	require.Error(t, err)
+}
+
+func TestSqlitePragmaOptions(t *testing.T) {
+	pragmas := func(t *testing.T, db *SqliteDb) (journalMode string, synchronous, busyTimeout int) {
+		t.Helper()
+		// Hold two connections at once so that both are checked.
+		ctx := context.Background()
+		for i := 0; i < 2; i++ {
+			conn, err := db.db.Conn(ctx)
+			require.NoError(t, err)
+			defer conn.Close()
+			require.NoError(t, conn.QueryRowContext(ctx, "PRAGMA journal_mode;").Scan(&journalMode))
+			require.NoError(t, conn.QueryRowContext(ctx, "PRAGMA synchronous;").Scan(&synchronous))
+			require.NoError(t, conn.QueryRowContext(ctx, "PRAGMA busy_timeout;").Scan(&busyTimeout))
+		}
+		return journalMode, synchronous, busyTimeout
+	}
+
+	t.Run("defaults", func(t *testing.T) {
+		journalMode, _, busyTimeout := pragmas(t, newTestSqliteDb(t, nil))
+		require.Equal(t, "wal", journalMode)
+		require.Equal(t, 5000, busyTimeout)
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		db := newTestSqliteDb(t, OptionsMap{
+			"journal_mode": "delete",
+			"synchronous":  "NORMAL",
+			"busy_timeout": 250,
+		})
+		journalMode, synchronous, busyTimeout := pragmas(t, db)
+		require.Equal(t, "delete", journalMode)
+		require.Equal(t, 1, synchronous)
+		require.Equal(t, 250, busyTimeout)
+	})
+
+	for _, opts := range []OptionsMap{
+		{"journal_mode": "JOURNAL"},
+		{"synchronous": "SOMETIMES"},
+		{"busy_timeout": -1},
+		{"busy_timeout": "soon"},
+	} {
+		_, err := NewSqliteDb("testdb", t.TempDir(), opts)
+		require.Error(t, err, opts)
+	}
+}
+
+func TestSqliteAutoCommitSingleConnection(t *testing.T) {
+	for _, opts := range []OptionsMap{
+		{"in_memory": true, "autocommit_ops": 10},
+		{"in_memory": true, "autocommit_interval": time.Second},
+		{"max_open_conns": 1, "autocommit_ops": 10},
+	} {
+		_, err := NewSqliteDb("testdb", t.TempDir(), opts)
+		require.ErrorContains(t, err, "autocommit", opts)
+	}
+
+	// With a single writer connection, reads missing the write buffer run on
+	// the read pool instead of waiting for the open transaction.
+	db := newTestSqliteDb(t, OptionsMap{"separate_read_write": true, "autocommit_ops": 10})
+	require.NoError(t, db.Set([]byte("a"), []byte{1}))
+	value, err := db.Get([]byte("missing"))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	has, err := db.Has([]byte("missing"))
+	require.NoError(t, err)
+	require.False(t, has)
+	values, err := db.MultiGet([][]byte{[]byte("a"), []byte("missing")})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{1}, nil}, values)
+}
+
+func TestSqliteInMemory(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"in_memory": true})
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+	other := newTestSqliteDb(t, OptionsMap{"in_memory": true})
+
+	batch := db.NewBatch()
+	for i := int64(0); i < 10; i++ {
+		require.NoError(t, batch.Set(int642Bytes(i), int642Bytes(i*i)))
+	}
+	// An open batch does not hold the single connection.
+	value, err := db.Get(int642Bytes(1))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+	require.NoError(t, db.Set(int642Bytes(10), int642Bytes(100)))
+
+	itr, err := db.Iterator(int642Bytes(2), int642Bytes(8))
+	require.NoError(t, err)
+	var keys []int64
+	for ; itr.Valid(); itr.Next() {
+		require.Equal(t, bytes2Int64(itr.Key())*bytes2Int64(itr.Key()), bytes2Int64(itr.Value()))
+		keys = append(keys, bytes2Int64(itr.Key()))
+	}
+	require.NoError(t, itr.Error())
+	require.NoError(t, itr.Close())
+	require.Equal(t, []int64{2, 3, 4, 5, 6, 7}, keys)
+
+	// The data survives idle periods and exclusive sections.
+	require.NoError(t, db.WithExclusive(func() error { return nil }))
+	value, err = db.Get(int642Bytes(10))
+	require.NoError(t, err)
+	require.Equal(t, int642Bytes(100), value)
+
+	// In-memory stores are independent and leave nothing on disk.
+	has, err := other.Has(int642Bytes(10))
+	require.NoError(t, err)
+	require.False(t, has)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestSqliteBinaryKeyOrder(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	keys := [][]byte{
+		{0x41}, {0xff}, {0x00, 0x01}, {0x00}, {0x41, 0x00, 0x42}, {0xc3, 0x28}, {0x00, 0x00}, {0x7f, 0xff},
+	}
+	for _, key := range keys {
+		require.NoError(t, db.Set(key, append([]byte{0x00}, key...)))
+	}
+	sorted := slices.Clone(keys)
+	slices.SortFunc(sorted, bytes.Compare)
+
+	for _, reverse := range []bool{false, true} {
+		var (
+			itr Iterator
+			err error
+		)
+		if reverse {
+			itr, err = db.ReverseIterator(nil, nil)
+		} else {
+			itr, err = db.Iterator(nil, nil)
+		}
+		require.NoError(t, err)
+		var got [][]byte
+		for ; itr.Valid(); itr.Next() {
+			require.Equal(t, append([]byte{0x00}, itr.Key()...), itr.Value())
+			got = append(got, itr.Key())
+		}
+		require.NoError(t, itr.Close())
+		if reverse {
+			slices.Reverse(got)
+		}
+		require.Equal(t, sorted, got)
+	}
+
+	schema, err := db.Schema()
+	require.NoError(t, err)
+	require.Contains(t, schema, "key BLOB not null")
+	require.Contains(t, schema, "value BLOB not null")
+}
+
+func TestSqliteEncryptionKeyWithoutCipher(t *testing.T) {
+	var version string
+	err := newTestSqliteDb(t, nil).db.QueryRow(`PRAGMA cipher_version;`).Scan(&version)
+	if err == nil {
+		t.Skip("linked against SQLCipher, see sqlite_sqlcipher_test.go")
+	}
+
+	// Standard builds ignore PRAGMA key; the database must not silently be
+	// left unencrypted.
+	_, err = NewSqliteDb("testdb", t.TempDir(), OptionsMap{"encryption_key": "secret"})
+	require.ErrorIs(t, err, errSqliteNoCipher)
+}
+
+func TestSqliteEmptyValue(t *testing.T) {
+	for name, opts := range map[string]OptionsMap{
+		"default":    nil,
+		"autocommit": {"autocommit_ops": 100},
+		"read cache": {"read_cache": NewReadCache(1 << 20)},
+		// A decoder may well return nil for an empty value.
+		"codec": {
+			"encode_value": func(value []byte) ([]byte, error) { return value, nil },
+			"decode_value": func(stored []byte) ([]byte, bool, error) {
+				if len(stored) == 0 {
+					return nil, false, nil
+				}
+				return stored, false, nil
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := newTestSqliteDb(t, opts)
+			require.NoError(t, db.Set([]byte("empty"), []byte{}))
+
+			// Twice, to read through the read cache.
+			for i := 0; i < 2; i++ {
+				has, err := db.Has([]byte("empty"))
+				require.NoError(t, err)
+				require.True(t, has)
+				value, err := db.Get([]byte("empty"))
+				require.NoError(t, err)
+				require.NotNil(t, value)
+				require.Empty(t, value)
+			}
+			require.NoError(t, db.Flush())
+			has, err := db.Has([]byte("empty"))
+			require.NoError(t, err)
+			require.True(t, has)
+
+			has, err = db.Has([]byte("missing"))
+			require.NoError(t, err)
+			require.False(t, has)
+			value, err := db.Get([]byte("missing"))
+			require.NoError(t, err)
+			require.Nil(t, value)
+		})
+	}
+}
+
+func TestSqliteReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewSqliteDb("testdb", dir, OptionsMap{"read_only": true})
+	require.Error(t, err, "a read-only store does not create the database")
+
+	// The writer stays open, as a running node would.
+	writer, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer writer.Close()
+	for i := int64(0); i < 10; i++ {
+		require.NoError(t, writer.Set(int642Bytes(i), int642Bytes(i)))
+	}
+
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"read_only": true})
+	require.NoError(t, err)
+	defer db.Close()
+
+	value, err := db.Get(int642Bytes(3))
+	require.NoError(t, err)
+	require.Equal(t, int642Bytes(3), value)
+	has, err := db.Has(int642Bytes(3))
+	require.NoError(t, err)
+	require.True(t, has)
+	itr, err := db.ReverseIterator(nil, nil)
+	require.NoError(t, err)
+	verifyIterator(t, itr, []int64{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}, "read-only reverse iteration")
+	require.NoError(t, itr.Close())
+
+	require.ErrorIs(t, db.Set(int642Bytes(3), []byte{1}), errReadOnly)
+	require.ErrorIs(t, db.SetSync(int642Bytes(3), []byte{1}), errReadOnly)
+	require.ErrorIs(t, db.Delete(int642Bytes(3)), errReadOnly)
+	require.ErrorIs(t, db.DeleteSync(int642Bytes(3)), errReadOnly)
+	require.ErrorIs(t, db.DeleteRange(nil, nil), errReadOnly)
+	_, err = db.Incr(int642Bytes(3), 1)
+	require.ErrorIs(t, err, errReadOnly)
+	batch := db.NewBatch()
+	require.ErrorIs(t, batch.Set(int642Bytes(3), []byte{1}), errReadOnly)
+	require.ErrorIs(t, batch.Delete(int642Bytes(3)), errReadOnly)
+	require.ErrorIs(t, batch.Write(), errReadOnly)
+	require.NoError(t, batch.Close())
+
+	// The read-only store sees later writes.
+	require.NoError(t, writer.Set(int642Bytes(3), []byte{1}))
+	value, err = db.Get(int642Bytes(3))
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, value)
+
+	// The database can also be opened once the writer is closed, which
+	// removes the WAL files.
+	require.NoError(t, db.Close())
+	require.NoError(t, writer.Close())
+	db, err = NewSqliteDb("testdb", dir, OptionsMap{"read_only": true})
+	require.NoError(t, err)
+	defer db.Close()
+	value, err = db.Get(int642Bytes(3))
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, value)
+
+	_, err = NewSqliteDb("testdb", dir, OptionsMap{"read_only": true, "in_memory": true})
+	require.Error(t, err)
+}
+
+func TestSqliteNamespace(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"autocommit_ops": 100})
+	require.NoError(t, err)
+	defer db.Close()
+	blocks, err := db.Namespace("blocks")
+	require.NoError(t, err)
+	state, err := db.Namespace("state")
+	require.NoError(t, err)
+
+	// The same keys hold different values in each namespace, interleaving
+	// with the keys of the other one.
+	for i := int64(0); i < 10; i++ {
+		require.NoError(t, db.Set(int642Bytes(2*i), int642Bytes(i)))
+		require.NoError(t, blocks.Set(int642Bytes(2*i+1), int642Bytes(-i)))
+	}
+	require.NoError(t, blocks.Set(int642Bytes(4), []byte("block")))
+	require.NoError(t, db.Delete(int642Bytes(6)))
+	checkValue(t, db, int642Bytes(4), int642Bytes(2))
+	checkValue(t, state, int642Bytes(4), int642Bytes(2))
+	checkValue(t, blocks, int642Bytes(4), []byte("block"))
+	checkValue(t, blocks, int642Bytes(2), nil)
+	checkValue(t, db, int642Bytes(3), nil)
+	has, err := blocks.Has(int642Bytes(6))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// Iterators only see the keys of their namespace, whatever the bounds.
+	itr, err := blocks.Iterator(int642Bytes(2), int642Bytes(10))
+	require.NoError(t, err)
+	verifyIterator(t, itr, []int64{3, 4, 5, 7, 9}, "blocks iteration")
+	require.NoError(t, itr.Close())
+	itr, err = state.ReverseIterator(nil, int642Bytes(9))
+	require.NoError(t, err)
+	verifyIterator(t, itr, []int64{8, 4, 2, 0}, "state reverse iteration")
+	require.NoError(t, itr.Close())
+	count, err := blocks.CountRange(nil, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 11, count)
+
+	batch := blocks.NewBatch()
+	require.NoError(t, batch.Delete(int642Bytes(4)))
+	require.NoError(t, batch.Set(int642Bytes(8), []byte("block")))
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+	checkValue(t, blocks, int642Bytes(4), nil)
+	checkValue(t, db, int642Bytes(4), int642Bytes(2))
+	checkValue(t, db, int642Bytes(8), int642Bytes(4))
+
+	// Closing a namespace leaves the database open, and namespaces persist.
+	require.NoError(t, blocks.Close())
+	checkValue(t, db, int642Bytes(8), int642Bytes(4))
+	require.NoError(t, db.Close())
+	db, err = NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	blocks, err = db.Namespace("blocks")
+	require.NoError(t, err)
+	checkValue(t, blocks, int642Bytes(8), []byte("block"))
+	checkValue(t, blocks, int642Bytes(9), int642Bytes(-4))
+
+	// Open namespace iterators hold off compaction.
+	itr, err = blocks.Iterator(nil, nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, db.Compact(), errIteratorsOpen)
+	require.NoError(t, itr.Close())
+	require.NoError(t, blocks.Compact())
+
+	for _, name := range []string{"", "Blocks", "a-b", "x; DROP TABLE state_storage"} {
+		_, err := db.Namespace(name)
+		require.Error(t, err, name)
+	}
+}
+
+func TestSqliteNamespaceAutoCommit(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"autocommit_interval": time.Hour, "busy_timeout": 50})
+	require.NoError(t, err)
+	defer db.Close()
+	other, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer other.Close()
+
+	// Creating a namespace does not wait for the open auto-commit transaction,
+	// which it commits first.
+	require.NoError(t, db.Set([]byte("a"), []byte{1}))
+	blocks, err := db.Namespace("blocks")
+	require.NoError(t, err)
+	checkValue(t, other, []byte("a"), []byte{1})
+
+	// Opening an existing namespace leaves it open.
+	require.NoError(t, db.Set([]byte("b"), []byte{2}))
+	_, err = db.Namespace("blocks")
+	require.NoError(t, err)
+	checkValue(t, other, []byte("b"), nil)
+	require.NoError(t, blocks.Set([]byte("a"), []byte{3}))
+	checkValue(t, blocks, []byte("a"), []byte{3})
+}
+
+func TestSqliteSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"autocommit_ops": 100})
+	require.NoError(t, err)
+	defer db.Close()
+	other, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer other.Close()
+
+	for i := int64(0); i < 10; i++ {
+		require.NoError(t, db.Set(int642Bytes(i), int642Bytes(i)))
+	}
+	// Buffered auto-commit writes are part of the snapshot.
+	snap, err := db.NewSnapshot()
+	require.NoError(t, err)
+	itr, err := snap.Iterator(nil, nil)
+	require.NoError(t, err)
+	require.True(t, itr.Valid())
+
+	// Writes through another handle proceed while the snapshot is open, and
+	// the snapshot does not observe them, even mid-iteration.
+	require.NoError(t, other.Set(int642Bytes(3), []byte("changed")))
+	require.NoError(t, other.Delete(int642Bytes(5)))
+	require.NoError(t, other.Set(int642Bytes(100), []byte("new")))
+	checkValue(t, db, int642Bytes(3), []byte("changed"))
+
+	verifyIterator(t, itr, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, "snapshot iteration")
+	require.NoError(t, itr.Close())
+	value, err := snap.Get(int642Bytes(3))
+	require.NoError(t, err)
+	require.Equal(t, int642Bytes(3), value)
+	value, err = snap.Get(int642Bytes(100))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	has, err := snap.Has(int642Bytes(5))
+	require.NoError(t, err)
+	require.True(t, has)
+	itr, err = snap.ReverseIterator(int642Bytes(4), nil)
+	require.NoError(t, err)
+	verifyIterator(t, itr, []int64{9, 8, 7, 6, 5, 4}, "snapshot reverse iteration")
+
+	// Closing the snapshot closes its iterators and ends its transaction, so
+	// the WAL can be checkpointed entirely.
+	require.NoError(t, snap.Close())
+	require.False(t, itr.Valid())
+	require.NoError(t, snap.Close())
+	_, err = snap.Get(int642Bytes(3))
+	require.ErrorIs(t, err, errSnapshotClosed)
+	_, err = snap.Iterator(nil, nil)
+	require.ErrorIs(t, err, errSnapshotClosed)
+	var busy, logFrames, checkpointed int
+	require.NoError(t, db.db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE);`).Scan(&busy, &logFrames, &checkpointed))
+	require.Zero(t, busy)
+
+	// Open snapshots, including those of namespaces, hold off compaction.
+	blocks, err := db.Namespace("blocks")
+	require.NoError(t, err)
+	snap, err = blocks.NewSnapshot()
+	require.NoError(t, err)
+	require.ErrorIs(t, db.Compact(), errSnapshotsOpen)
+	require.NoError(t, snap.Close())
+	require.NoError(t, db.Compact())
+
+	// A snapshot would hold the single connection of the pool.
+	for _, opts := range []OptionsMap{{"in_memory": true}, {"max_open_conns": 1}} {
+		_, err := newTestSqliteDb(t, opts).NewSnapshot()
+		require.ErrorIs(t, err, errSnapshotSingleConn, opts)
+	}
+
+	// Closing the store closes the snapshots that are still open.
+	snap, err = db.NewSnapshot()
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+	_, err = snap.Has(int642Bytes(3))
+	require.ErrorIs(t, err, errSnapshotClosed)
+}
+
+func TestSqliteSearchFirst(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	for i := int64(0); i < 100; i += 2 {
+		require.NoError(t, db.Set(int642Bytes(i), []byte{1}))
+	}
+
+	count, err := db.CountRange(int642Bytes(10), int642Bytes(20))
+	require.NoError(t, err)
+	require.EqualValues(t, 5, count)
+
+	key, err := db.KeyAtRank(int642Bytes(10), nil, 2)
+	require.NoError(t, err)
+	require.Equal(t, int642Bytes(14), key)
+	key, err = db.KeyAtRank(nil, nil, 50)
+	require.NoError(t, err)
+	require.Nil(t, key)
+
+	atLeast := func(n int64) func([]byte) bool {
+		return func(key []byte) bool { return bytes2Int64(key) >= n }
+	}
+
+	// The boundary falls between stored keys.
+	key, err = db.SearchFirst(nil, nil, atLeast(37))
+	require.NoError(t, err)
+	require.Equal(t, int642Bytes(38), key)
+
+	// The boundary is a stored key.
+	key, err = db.SearchFirst(nil, nil, atLeast(38))
+	require.NoError(t, err)
+	require.Equal(t, int642Bytes(38), key)
+
+	// The predicate holds for the whole range.
+	key, err = db.SearchFirst(int642Bytes(20), int642Bytes(30), atLeast(0))
+	require.NoError(t, err)
+	require.Equal(t, int642Bytes(20), key)
+
+	// The predicate never holds within the range.
+	key, err = db.SearchFirst(nil, int642Bytes(30), atLeast(37))
+	require.NoError(t, err)
+	require.Nil(t, key)
+
+	// Writes made while searching do not shift the ranks being probed.
+	written := false
+	key, err = db.SearchFirst(nil, nil, func(key []byte) bool {
+		if !written {
+			for i := int64(1); i < 30; i += 2 {
+				require.NoError(t, db.Set(int642Bytes(i), []byte{1}))
+			}
+			written = true
+		}
+		return bytes2Int64(key) >= 37
+	})
+	require.NoError(t, err)
+	require.Equal(t, int642Bytes(38), key)
+
+	_, err = db.SearchFirst([]byte{}, nil, atLeast(0))
+	require.Equal(t, errKeyEmpty, err)
+}
+
+func TestSqliteSharedReadCache(t *testing.T) {
+	const budget = 200
+	cache := NewReadCache(budget)
+	db1 := newTestSqliteDb(t, OptionsMap{"read_cache": cache})
+	db2 := newTestSqliteDb(t, OptionsMap{"read_cache": cache})
+
+	// The same keys hold different values in each store.
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%02d", i))
+		require.NoError(t, db1.Set(key, []byte(fmt.Sprintf("db1-value-%02d", i))))
+		require.NoError(t, db2.Set(key, []byte(fmt.Sprintf("db2-value-%02d", i))))
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 20; i++ {
+			key := []byte(fmt.Sprintf("key-%02d", i))
+			checkValue(t, db1, key, []byte(fmt.Sprintf("db1-value-%02d", i)))
+			checkValue(t, db2, key, []byte(fmt.Sprintf("db2-value-%02d", i)))
+			require.LessOrEqual(t, cache.Size(), int64(budget))
+		}
+	}
+	require.Greater(t, cache.Len(), 0)
+
+	// Writes through either store invalidate only that store's entries.
+	key := []byte("key-19")
+	require.NoError(t, db1.Set(key, []byte("updated")))
+	checkValue(t, db1, key, []byte("updated"))
+	checkValue(t, db2, key, []byte("db2-value-19"))
+
+	batch := db2.NewBatch()
+	require.NoError(t, batch.Delete(key))
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+	checkValue(t, db2, key, nil)
+	checkValue(t, db1, key, []byte("updated"))
+
+	// Closing a store releases its entries.
+	require.NoError(t, db1.Close())
+	checkValue(t, db2, []byte("key-18"), []byte("db2-value-18"))
+	require.LessOrEqual(t, cache.Size(), int64(budget))
+	cache.mtx.Lock()
+	for _, elem := range cache.entries {
+		require.NotEqual(t, db1.storeID, elem.Value.(*readCacheEntry).key.store)
+	}
+	cache.mtx.Unlock()
+}
+
+func TestSqliteAutoCommitWriteBuffer(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"autocommit_interval": time.Hour})
+	require.NoError(t, err)
+	defer db.Close()
+	other, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer other.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := []byte(fmt.Sprintf("key-%d-%d", w, i))
+				value := []byte(fmt.Sprintf("value-%d-%d", w, i))
+				assert.NoError(t, db.Set(key, value))
+				checkValue(t, db, key, value)
+				ok, err := db.Has(key)
+				assert.NoError(t, err)
+				assert.True(t, ok)
+
+				if i%2 == 0 {
+					assert.NoError(t, db.Delete(key))
+					checkValue(t, db, key, nil)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Nothing is committed yet, and committing clears the buffer.
+	checkValue(t, other, []byte("key-0-1"), nil)
+	require.NotEmpty(t, db.ac.pending)
+	require.NoError(t, db.Flush())
+	require.Empty(t, db.ac.pending)
+	checkValue(t, other, []byte("key-0-1"), []byte("value-0-1"))
+	checkValue(t, db, []byte("key-0-1"), []byte("value-0-1"))
+	checkValue(t, db, []byte("key-0-2"), nil)
+}
+
+func TestSqliteVersion(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+
+	version, err := db.SQLiteVersion()
+	require.NoError(t, err)
+	require.Regexp(t, `^3\.\d+\.\d+`, version)
+
+	options, err := db.CompileOptions()
+	require.NoError(t, err)
+	require.NotEmpty(t, options)
+
+	stats := db.Stats()
+	require.Equal(t, version, stats["sqlite.version"])
+	require.NotEmpty(t, stats["sqlite.compile_options"])
+}
+
+func TestSqliteStats(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	require.NoError(t, db.Set([]byte("a"), []byte("1")))
+	_, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+
+	// Hold a connection while a second caller is served by another one.
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	_, err = db.Get([]byte("a"))
+	require.NoError(t, err)
+	stats := db.Stats()
+	require.NoError(t, itr.Close())
+
+	for _, key := range []string{
+		"max_open_connections", "open_connections", "in_use", "idle", "wait_count",
+		"wait_duration", "max_idle_closed", "max_idle_time_closed", "max_lifetime_closed",
+	} {
+		require.Contains(t, stats, key)
+		_, err := strconv.ParseInt(stats[key], 10, 64)
+		require.NoError(t, err, key)
+	}
+	require.Equal(t, strconv.Itoa(defaultSqliteMaxOpenConns), stats["max_open_connections"])
+	require.Equal(t, "1", stats["in_use"])
+	require.Equal(t, "2", stats["open_connections"])
+}
+
+func TestSqliteSize(t *testing.T) {
+	dir := t.TempDir()
+	for _, opts := range []OptionsMap{nil, {"in_memory": true}} {
+		db, err := NewSqliteDb("testdb", dir, opts)
+		require.NoError(t, err)
+		defer db.Close()
+
+		count, err := db.Count()
+		require.NoError(t, err)
+		require.Zero(t, count)
+		empty, err := db.DiskSize()
+		require.NoError(t, err)
+		require.Positive(t, empty)
+
+		value := bytes.Repeat([]byte{1}, 1024)
+		for i := int64(0); i < 200; i++ {
+			require.NoError(t, db.Set(int642Bytes(i), value))
+		}
+		require.NoError(t, db.Delete(int642Bytes(0)))
+		count, err = db.Count()
+		require.NoError(t, err)
+		require.EqualValues(t, 199, count)
+		size, err := db.DiskSize()
+		require.NoError(t, err)
+		require.Greater(t, size, empty+199*1024)
+
+		stats := db.Stats()
+		require.Equal(t, "199", stats["num_keys"])
+		require.Equal(t, strconv.FormatInt(size, 10), stats["disk_size_bytes"])
+
+		// The count is reused until it is taken again.
+		require.NoError(t, db.Set(int642Bytes(0), value))
+		require.Equal(t, "199", db.Stats()["num_keys"])
+		count, err = db.Count()
+		require.NoError(t, err)
+		require.EqualValues(t, 200, count)
+		require.Equal(t, "200", db.Stats()["num_keys"])
+	}
+
+	// The files include the WAL until it is checkpointed.
+	path := filepath.Join(dir, "testdb"+DBFileSuffix)
+	db, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	size, err := db.DiskSize()
+	require.NoError(t, err)
+	var files int64
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		info, err := os.Stat(path + suffix)
+		require.NoError(t, err)
+		files += info.Size()
+	}
+	require.Equal(t, files, size)
+}
+
+func TestSqlitePoolOptions(t *testing.T) {
+	db := newTestSqliteDb(t, OptionsMap{
+		"max_open_conns":    3,
+		"max_idle_conns":    1,
+		"conn_max_lifetime": "1m",
+	})
+	require.Equal(t, "3", db.Stats()["max_open_connections"])
+
+	// Exclusive sections restore the configured limits.
+	require.NoError(t, db.WithExclusive(func() error { return nil }))
+	require.Equal(t, "3", db.Stats()["max_open_connections"])
+
+	// Only one of two released connections is kept idle.
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	_, err = db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.NoError(t, itr.Close())
+	stats := db.Stats()
+	require.Equal(t, "1", stats["idle"])
+	require.Equal(t, "1", stats["max_idle_closed"])
+
+	db = newTestSqliteDb(t, OptionsMap{"in_memory": true, "max_open_conns": 4})
+	require.Equal(t, "1", db.Stats()["max_open_connections"])
+
+	// File-backed stores default to a bounded pool; 0 lifts the bound.
+	db = newTestSqliteDb(t, nil)
+	require.Equal(t, strconv.Itoa(defaultSqliteMaxOpenConns), db.Stats()["max_open_connections"])
+	db = newTestSqliteDb(t, OptionsMap{"max_open_conns": 0})
+	require.Equal(t, "0", db.Stats()["max_open_connections"])
+
+	for _, opts := range []OptionsMap{
+		{"max_open_conns": -1},
+		{"max_idle_conns": "many"},
+		{"conn_max_lifetime": "forever"},
+	} {
+		_, err := NewSqliteDb("testdb", t.TempDir(), opts)
+		require.Error(t, err, opts)
+	}
+}
+
+// diffDBs returns the changes that turn the contents of from into those of to.
+func diffDBs(t *testing.T, from, to DB) (added, changed []KV, removed [][]byte) {
+	t.Helper()
+	fromItr, err := from.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer fromItr.Close()
+	toItr, err := to.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer toItr.Close()
+
+	for fromItr.Valid() || toItr.Valid() {
+		switch {
+		case !toItr.Valid() || (fromItr.Valid() && bytes.Compare(fromItr.Key(), toItr.Key()) < 0):
+			removed = append(removed, fromItr.Key())
+			fromItr.Next()
+		case !fromItr.Valid() || bytes.Compare(fromItr.Key(), toItr.Key()) > 0:
+			added = append(added, KV{Key: toItr.Key(), Value: toItr.Value()})
+			toItr.Next()
+		default:
+			if !bytes.Equal(fromItr.Value(), toItr.Value()) {
+				changed = append(changed, KV{Key: toItr.Key(), Value: toItr.Value()})
+			}
+			fromItr.Next()
+			toItr.Next()
+		}
+	}
+	return added, changed, removed
+}
+
+func TestSqliteApplyDiff(t *testing.T) {
+	a := newTestSqliteDb(t, nil)
+	b := newTestSqliteDb(t, nil)
+
+	for k, v := range map[string][]byte{"a": {1}, "b": {2}, "c": {3}, "e": {5}} {
+		require.NoError(t, a.Set([]byte(k), v))
+	}
+	for k, v := range map[string][]byte{"b": {2}, "c": {30}, "d": {4}, "f": {6}} {
+		require.NoError(t, b.Set([]byte(k), v))
+	}
+
+	added, changed, removed := diffDBs(t, a, b)
+	require.Len(t, added, 2)
+	require.Len(t, changed, 1)
+	require.Len(t, removed, 2)
+
+	require.NoError(t, a.ApplyDiff(added, changed, removed))
+	assertKeyValues(t, a, map[string][]byte{"b": {2}, "c": {30}, "d": {4}, "f": {6}})
+
+	added, changed, removed = diffDBs(t, a, b)
+	require.Empty(t, added)
+	require.Empty(t, changed)
+	require.Empty(t, removed)
+
+	// Invalid entries abort the whole diff.
+	err := a.ApplyDiff([]KV{{Key: []byte("g"), Value: []byte{7}}}, nil, [][]byte{{}})
+	require.Equal(t, errKeyEmpty, err)
+	checkValue(t, a, []byte("g"), nil)
+}
+
+func TestSqliteIteratorWithTimeout(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	batch := db.NewBatch()
+	for i := int64(0); i < 1000; i++ {
+		require.NoError(t, batch.Set(int642Bytes(i), []byte{1}))
+	}
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+
+	itr, err := db.IteratorWithTimeout(nil, nil, 20*time.Millisecond)
+	require.NoError(t, err)
+	scanned := 0
+	for ; itr.Valid(); itr.Next() {
+		scanned++
+		time.Sleep(time.Millisecond)
+	}
+	require.Less(t, scanned, 1000)
+	require.ErrorIs(t, itr.Error(), context.DeadlineExceeded)
+	require.NoError(t, itr.Close())
+
+	// Other scans are unaffected by the timeout.
+	itr, err = db.ReverseIteratorWithTimeout(nil, nil, time.Minute)
+	require.NoError(t, err)
+	scanned = 0
+	for ; itr.Valid(); itr.Next() {
+		scanned++
+	}
+	require.NoError(t, itr.Error())
+	require.Equal(t, 1000, scanned)
+	require.NoError(t, itr.Close())
+}
+
+func TestSqliteContext(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for i := int64(0); i < 100; i++ {
+		require.NoError(t, db.SetContext(ctx, int642Bytes(i), int642Bytes(i)))
+	}
+	value, err := db.GetContext(ctx, int642Bytes(7))
+	require.NoError(t, err)
+	require.Equal(t, int642Bytes(7), value)
+
+	itr, err := db.IteratorContext(ctx, nil, nil)
+	require.NoError(t, err)
+	scanned := 0
+	for ; itr.Valid(); itr.Next() {
+		scanned++
+		if scanned == 10 {
+			cancel()
+		}
+	}
+	require.Equal(t, 10, scanned)
+	require.ErrorIs(t, itr.Error(), context.Canceled)
+	require.NoError(t, itr.Close())
+
+	_, err = db.GetContext(ctx, int642Bytes(7))
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, db.SetContext(ctx, int642Bytes(7), []byte{1}), context.Canceled)
+	_, err = db.ReverseIteratorContext(ctx, nil, nil)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// The store itself is unaffected.
+	value, err = db.Get(int642Bytes(7))
+	require.NoError(t, err)
+	require.Equal(t, int642Bytes(7), value)
+}
+
+func TestSqliteBusyRetry(t *testing.T) {
+	// Without a busy timeout, concurrent writers get SQLITE_BUSY right away.
+	db := newTestSqliteDb(t, OptionsMap{
+		"busy_timeout":     0,
+		"busy_attempts":    100,
+		"busy_retry_delay": time.Millisecond,
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for w := int64(0); w < 2; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int64(0); i < 100; i++ {
+				batch := db.NewBatch()
+				for j := int64(0); j < 10; j++ {
+					if err := batch.Set(int642Bytes(w*10000+i*10+j), []byte{1}); err != nil {
+						errs <- err
+						return
+					}
+				}
+				err := batch.Write()
+				_ = batch.Close()
+				if err == nil {
+					err = db.Set(int642Bytes(w*10000+i*10), []byte{2})
+				}
+				if err == nil {
+					err = db.Delete(int642Bytes(w*10000 + i*10 + 9))
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	count, err := db.CountRange(nil, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 2*100*9, count)
+}
+
+func TestSqliteRetryBusyOptions(t *testing.T) {
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+	o, err := parseSqliteOptions(OptionsMap{"busy_attempts": 3, "busy_retry_delay": "1ms"})
+	require.NoError(t, err)
+
+	calls := 0
+	err = o.retryBusy(context.Background(), func() error {
+		calls++
+		return fmt.Errorf("wrapped: %w", busy)
+	})
+	require.ErrorIs(t, err, busy)
+	require.Equal(t, 3, calls)
+
+	// Other errors are not retried.
+	calls = 0
+	err = o.retryBusy(context.Background(), func() error {
+		calls++
+		return sqlite3.Error{Code: sqlite3.ErrConstraint}
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+
+	for _, opts := range []OptionsMap{{"busy_attempts": 0}, {"busy_retry_delay": "soon"}} {
+		_, err := parseSqliteOptions(opts)
+		require.Error(t, err, opts)
+	}
+}
+
+func TestSqliteBatchReuse(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	batch := db.NewBatch().(*sqliteBatch)
+	defer batch.Close()
+
+	require.NoError(t, batch.Set([]byte("a"), []byte{1}))
+	require.NoError(t, batch.Write())
+	require.Zero(t, batch.Size())
+
+	// Writing again without Reset does not re-apply the operations.
+	require.NoError(t, db.Delete([]byte("a")))
+	require.ErrorIs(t, batch.Write(), errBatchClosed)
+	require.ErrorIs(t, batch.Set([]byte("b"), []byte{2}), errBatchClosed)
+	assertKeyValues(t, db, map[string][]byte{})
+
+	// After Reset, only the new operations are written.
+	require.NoError(t, batch.Reset())
+	require.NoError(t, batch.Set([]byte("b"), []byte{2}))
+	size, err := batch.GetByteSize()
+	require.NoError(t, err)
+	require.Equal(t, 2, size)
+	require.NoError(t, batch.Write())
+	assertKeyValues(t, db, map[string][]byte{"b": {2}})
+
+	require.NoError(t, batch.Reset())
+	require.NoError(t, batch.Delete([]byte("b")))
+	require.NoError(t, batch.Write())
+	assertKeyValues(t, db, map[string][]byte{})
+}
+
+func TestSqliteBatchSetRuns(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	require.NoError(t, db.Set([]byte("k1"), []byte("old")))
+	require.NoError(t, db.Set([]byte("k4"), []byte("old")))
+
+	expect := map[string][]byte{"k1": []byte("old"), "k4": []byte("old")}
+	batch := db.NewBatch()
+	set := func(key, value string) {
+		require.NoError(t, batch.Set([]byte(key), []byte(value)))
+		expect[key] = []byte(value)
+	}
+	del := func(key string) {
+		require.NoError(t, batch.Delete([]byte(key)))
+		delete(expect, key)
+	}
+	// Sets and deletes of the same keys interleave, and runs of sets repeat
+	// keys, within and across multi-row statements.
+	set("k1", "a")
+	set("k2", "a")
+	set("k1", "b")
+	del("k1")
+	del("k4")
+	set("k4", "a")
+	set("k3", "")
+	del("k2")
+	set("k2", "b")
+	for i := 0; i < 3*sqliteBatchMaxSetRows+7; i++ {
+		set(fmt.Sprintf("run-%03d", i%700), strconv.Itoa(i))
+	}
+	del("run-005")
+	set("k1", "c")
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+
+	assertKeyValues(t, db, expect)
+}
+
+func TestSqliteMultiGet(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	for i := int64(0); i < 10; i += 2 {
+		require.NoError(t, db.Set(int642Bytes(i), int642Bytes(i*i)))
+	}
+	require.NoError(t, db.Set([]byte("empty"), []byte{}))
+
+	values, err := db.MultiGet([][]byte{int642Bytes(4), int642Bytes(3), []byte("empty"), int642Bytes(0), int642Bytes(4)})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{int642Bytes(16), nil, {}, int642Bytes(0), int642Bytes(16)}, values)
+
+	_, err = db.MultiGet([][]byte{int642Bytes(1), nil})
+	require.ErrorIs(t, err, errKeyEmpty)
+	values, err = db.MultiGet(nil)
+	require.NoError(t, err)
+	require.Empty(t, values)
+}
+
+func TestSqliteMultiGetChunks(t *testing.T) {
+	db := newTestSqliteDb(t, OptionsMap{"autocommit_ops": 10000})
+	const numKeys = 2500
+	keys := make([][]byte, 0, numKeys)
+	for i := int64(0); i < numKeys; i++ {
+		keys = append(keys, int642Bytes(i))
+		if i%3 != 0 {
+			require.NoError(t, db.Set(int642Bytes(i), int642Bytes(-i)))
+		}
+	}
+	// Some of the writes are only buffered in the auto-commit transaction.
+	require.NoError(t, db.Flush())
+	require.NoError(t, db.Set(int642Bytes(3), int642Bytes(-3)))
+	require.NoError(t, db.Delete(int642Bytes(4)))
+
+	values, err := db.MultiGet(keys)
+	require.NoError(t, err)
+	require.Len(t, values, numKeys)
+	for i, value := range values {
+		switch {
+		case i == 3:
+			require.Equal(t, int642Bytes(-3), value)
+		case i == 4 || i%3 == 0:
+			require.Nil(t, value, i)
+		default:
+			require.Equal(t, int642Bytes(int64(-i)), value, i)
+		}
+	}
+}
+
+func TestSqliteIncr(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	key := []byte("counter")
+
+	var (
+		wg  sync.WaitGroup
+		sum int64
+	)
+	for w := 0; w < 8; w++ {
+		delta := int64(w - 3)
+		sum += 25 * delta
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				_, err := db.Incr(key, delta)
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := db.Incr(key, 0)
+	require.NoError(t, err)
+	require.Equal(t, sum, value)
+	checkValue(t, db, key, int642Bytes(sum))
+
+	// Absent keys start at zero.
+	value, err = db.Incr([]byte("fresh"), -5)
+	require.NoError(t, err)
+	require.EqualValues(t, -5, value)
+
+	// Values that are not counters are rejected and left untouched.
+	require.NoError(t, db.Set([]byte("text"), []byte("hello")))
+	_, err = db.Incr([]byte("text"), 1)
+	require.Error(t, err)
+	checkValue(t, db, []byte("text"), []byte("hello"))
+
+	_, err = db.Incr(nil, 1)
+	require.Equal(t, errKeyEmpty, err)
+}
+
+func TestSqliteIncrAutoCommit(t *testing.T) {
+	db := newTestSqliteDb(t, OptionsMap{"autocommit_interval": time.Hour})
+
+	for i := 0; i < 3; i++ {
+		_, err := db.Incr([]byte("counter"), 2)
+		require.NoError(t, err)
+	}
+	checkValue(t, db, []byte("counter"), int642Bytes(6))
+	require.NoError(t, db.Flush())
+	checkValue(t, db, []byte("counter"), int642Bytes(6))
+}
+
+func TestSqliteSchema(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+
+	schema, err := db.Schema()
+	require.NoError(t, err)
+	require.Contains(t, schema, "CREATE TABLE state_storage")
+	require.Contains(t, schema, "CREATE UNIQUE INDEX idx_key ON state_storage (key)")
+	require.Less(t, strings.Index(schema, "CREATE TABLE"), strings.Index(schema, "CREATE UNIQUE INDEX"))
+}
+
+func TestSqliteSchemaMigration(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "testdb"+DBFileSuffix)
+
+	// Create a database the way versions before schema_version did. Keys
+	// bound as strings are stored as TEXT, which sorts before every BLOB.
+	old, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	for _, stmt := range []string{
+		`CREATE TABLE state_storage (id integer not null primary key, key varchar not null, value varchar not null, unique(key));`,
+		`CREATE UNIQUE INDEX idx_key ON state_storage (key);`,
+	} {
+		_, err = old.Exec(stmt)
+		require.NoError(t, err)
+	}
+	for _, kv := range []struct{ key, value any }{
+		{"b", "text"},
+		{[]byte{0xff}, []byte{1}},
+		{[]byte{0x01}, []byte{2}},
+		{"a\x00", []byte{}},
+	} {
+		_, err = old.Exec(`INSERT INTO state_storage (key, value) VALUES (?, ?);`, kv.key, kv.value)
+		require.NoError(t, err)
+	}
+	require.NoError(t, old.Close())
+
+	_, err = NewSqliteDb("testdb", dir, nil)
+	require.ErrorIs(t, err, errSqliteSchemaOutdated)
+	require.ErrorContains(t, err, "migrate_schema")
+	_, err = NewSqliteDb("testdb", dir, OptionsMap{"read_only": true})
+	require.ErrorIs(t, err, errSqliteSchemaOutdated)
+
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"migrate_schema": true})
+	require.NoError(t, err)
+	schema, err := db.Schema()
+	require.NoError(t, err)
+	require.Contains(t, schema, "key BLOB not null")
+	require.Contains(t, schema, "CREATE UNIQUE INDEX idx_key ON state_storage (key)")
+	require.Contains(t, schema, "CREATE TABLE schema_version")
+	require.NotContains(t, schema, "varchar")
+
+	// Keys now sort bytewise, whatever their storage class was.
+	expect := map[string][]byte{"b": []byte("text"), "\xff": {1}, "\x01": {2}, "a\x00": {}}
+	assertKeyValues(t, db, expect)
+	keys := make([][]byte, 0, len(expect))
+	for k := range expect {
+		keys = append(keys, []byte(k))
+	}
+	slices.SortFunc(keys, bytes.Compare)
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	for _, key := range keys {
+		require.True(t, itr.Valid())
+		require.Equal(t, key, itr.Key())
+		itr.Next()
+	}
+	require.False(t, itr.Valid())
+	require.NoError(t, itr.Close())
+	require.NoError(t, db.Set([]byte("c"), []byte{3}))
+	require.NoError(t, db.Close())
+
+	// The migration is recorded: the database opens without the option,
+	// read-only too, and is not migrated again.
+	db, err = NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	expect["c"] = []byte{3}
+	assertKeyValues(t, db, expect)
+	require.NoError(t, db.Close())
+	db, err = NewSqliteDb("testdb", dir, OptionsMap{"read_only": true, "migrate_schema": true})
+	require.NoError(t, err)
+	assertKeyValues(t, db, expect)
+	require.NoError(t, db.Close())
+}
+
+func TestSqliteOpenWhileWriting(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"autocommit_interval": time.Hour})
+	require.NoError(t, err)
+	defer db.Close()
+
+	// The open auto-commit transaction holds the write lock, which opening an
+	// up-to-date database does not need.
+	require.NoError(t, db.Set([]byte("a"), []byte{1}))
+	other, err := NewSqliteDb("testdb", dir, OptionsMap{"busy_timeout": 50})
+	require.NoError(t, err)
+	defer other.Close()
+	checkValue(t, other, []byte("a"), nil)
+	require.NoError(t, db.Flush())
+	checkValue(t, other, []byte("a"), []byte{1})
+}
+
+func TestSqliteWithExclusive(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	for i := int64(0); i < 100; i++ {
+		require.NoError(t, db.Set(int642Bytes(i), []byte("value")))
+	}
+
+	// Leave a few idle connections in the pool.
+	ctx := context.Background()
+	conn1, err := db.db.Conn(ctx)
+	require.NoError(t, err)
+	conn2, err := db.db.Conn(ctx)
+	require.NoError(t, err)
+	require.NoError(t, conn1.Close())
+	require.NoError(t, conn2.Close())
+	require.Equal(t, 2, db.db.Stats().Idle)
+
+	err = db.WithExclusive(func() error {
+		stats := db.db.Stats()
+		require.Equal(t, 1, stats.MaxOpenConnections)
+		require.Zero(t, stats.Idle)
+
+		if _, err := db.db.Exec(`PRAGMA auto_vacuum = FULL;`); err != nil {
+			return err
+		}
+		_, err := db.db.Exec(`VACUUM;`)
+		return err
+	})
+	require.NoError(t, err)
+
+	var autoVacuum int
+	require.NoError(t, db.db.QueryRow(`PRAGMA auto_vacuum;`).Scan(&autoVacuum))
+	require.Equal(t, 1, autoVacuum)
+	require.Equal(t, defaultSqliteMaxOpenConns, db.db.Stats().MaxOpenConnections)
+	checkValue(t, db, int642Bytes(42), []byte("value"))
+
+	// Errors from fn are returned and the pool is restored.
+	errFn := errors.New("maintenance failed")
+	require.Equal(t, errFn, db.WithExclusive(func() error { return errFn }))
+	require.Equal(t, defaultSqliteMaxOpenConns, db.db.Stats().MaxOpenConnections)
+}
+
+func TestSqliteCompact(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, db.Close()) })
+
+	fileSize := func() int64 {
+		var size int64
+		for _, suffix := range []string{"", "-wal"} {
+			info, err := os.Stat(filepath.Join(dir, "testdb"+DBFileSuffix+suffix))
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			require.NoError(t, err)
+			size += info.Size()
+		}
+		return size
+	}
+
+	value := bytes.Repeat([]byte{0xab}, 1024)
+	batch := db.NewBatch()
+	for i := int64(0); i < 2000; i++ {
+		require.NoError(t, batch.Set(int642Bytes(i), value))
+	}
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+	batch = db.NewBatch()
+	for i := int64(0); i < 1900; i++ {
+		require.NoError(t, batch.Delete(int642Bytes(i)))
+	}
+	require.NoError(t, batch.Write())
+	require.NoError(t, batch.Close())
+	before := fileSize()
+
+	// An open iterator makes Compact fail instead of waiting for it.
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	require.ErrorIs(t, db.Compact(), errIteratorsOpen)
+	require.NoError(t, itr.Close())
+
+	require.NoError(t, db.Compact())
+	require.Less(t, fileSize(), before/4)
+
+	count, err := db.CountRange(nil, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 100, count)
+}
+
+func TestSqliteCloseWithOpenIterators(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	for i := int64(0); i < 10; i++ {
+		require.NoError(t, db.Set(int642Bytes(i), []byte{1}))
+	}
+
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	require.True(t, itr.Valid())
+	reverse, err := db.ReverseIterator(nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, db.openIterators())
+
+	require.NoError(t, db.Close())
+	require.False(t, itr.Valid())
+	require.Zero(t, db.openIterators())
+	// Closing them again is harmless.
+	require.NoError(t, itr.Close())
+	require.NoError(t, reverse.Close())
+
+	db, err = NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	count, err := db.CountRange(nil, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, count)
+}
+
+func TestSqliteBackup(t *testing.T) {
+	for _, journalMode := range []string{"WAL", "DELETE"} {
+		t.Run(journalMode, func(t *testing.T) {
+			db := newTestSqliteDb(t, OptionsMap{"journal_mode": journalMode})
+			expect := map[string][]byte{}
+			for i := int64(0); i < 100; i++ {
+				require.NoError(t, db.Set(int642Bytes(i), int642Bytes(i*i)))
+				expect[string(int642Bytes(i))] = int642Bytes(i * i)
+			}
+			// Keep an iterator open, as a concurrent reader would.
+			itr, err := db.Iterator(nil, nil)
+			require.NoError(t, err)
+
+			dir := t.TempDir()
+			destPath := filepath.Join(dir, "backup"+DBFileSuffix)
+			require.NoError(t, db.Backup(destPath))
+			require.ErrorIs(t, db.Backup(destPath), os.ErrExist)
+			require.NoError(t, itr.Close())
+
+			// Later writes do not reach the backup.
+			require.NoError(t, db.Set(int642Bytes(1000), []byte{1}))
+
+			backup, err := NewSqliteDb("backup", dir, nil)
+			require.NoError(t, err)
+			defer backup.Close()
+			assertKeyValues(t, backup, expect)
+		})
+	}
+}
+
+func TestSqliteSyncWrites(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, OptionsMap{"autocommit_ops": 100})
+	require.NoError(t, err)
+
+	require.NoError(t, db.Set([]byte("a"), []byte{1}))
+	require.NoError(t, db.SetSync([]byte("b"), []byte{2}))
+	require.NoError(t, db.SetSync([]byte("c"), []byte{3}))
+	require.NoError(t, db.DeleteSync([]byte("c")))
+	batch := db.NewBatch()
+	require.NoError(t, batch.Set([]byte("d"), []byte{4}))
+	require.NoError(t, batch.WriteSync())
+	require.ErrorIs(t, batch.Write(), errBatchClosed)
+	require.NoError(t, batch.Close())
+
+	// The connections of the faster path keep their synchronous mode.
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		conn, err := db.db.Conn(ctx)
+		require.NoError(t, err)
+		defer conn.Close()
+		var synchronous int
+		require.NoError(t, conn.QueryRowContext(ctx, `PRAGMA synchronous;`).Scan(&synchronous))
+		require.Equal(t, 1, synchronous, "NORMAL")
+	}
+	err = withSqliteSynchronousFull(ctx, db.db, func(conn *sql.Conn) error {
+		var synchronous int
+		require.NoError(t, conn.QueryRowContext(ctx, `PRAGMA synchronous;`).Scan(&synchronous))
+		require.Equal(t, 2, synchronous, "FULL")
+		return nil
+	})
+	require.NoError(t, err)
+
+	// The writes survive reopening the database without closing it first.
+	db2, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer db2.Close()
+	assertKeyValues(t, db2, map[string][]byte{"a": {1}, "b": {2}, "d": {4}})
+	require.NoError(t, db.Close())
+
+	require.ErrorIs(t, db2.SetSync(nil, []byte{1}), errKeyEmpty)
+	require.ErrorIs(t, db2.SetSync([]byte("a"), nil), errValueNil)
+	require.ErrorIs(t, db2.DeleteSync(nil), errKeyEmpty)
+}
+
+func TestSqliteSyncWritesConcurrentAutoCommit(t *testing.T) {
+	// The auto-commit transaction holds the write lock until the next
+	// interval, and busy writes give up quickly.
+	db := newTestSqliteDb(t, OptionsMap{
+		"autocommit_interval": 30 * time.Second,
+		"busy_timeout":        50,
+		"busy_attempts":       2,
+	})
+
+	stop := setSqliteConcurrently(t, db)
+	for i := 0; i < 50; i++ {
+		key := int642Bytes(int64(i))
+		require.NoError(t, db.SetSync(key, []byte{1}))
+		if i%2 == 0 {
+			require.NoError(t, db.DeleteSync(key))
+		}
+	}
+	stop()
+
+	checkValue(t, db, int642Bytes(0), nil)
+	checkValue(t, db, int642Bytes(1), []byte{1})
+}
+
+func TestSqliteMaintenanceConcurrentAutoCommit(t *testing.T) {
+	db := newTestSqliteDb(t, OptionsMap{
+		"autocommit_interval": 30 * time.Second,
+		"busy_timeout":        50,
+		"busy_attempts":       2,
+	})
+	for i := int64(0); i < 100; i++ {
+		require.NoError(t, db.Set(int642Bytes(i), []byte{1}))
+	}
+
+	stop := setSqliteConcurrently(t, db)
+	for i := int64(0); i < 10; i++ {
+		require.NoError(t, db.DeleteRange(int642Bytes(i*10), int642Bytes(i*10+5)))
+		_, err := db.Checkpoint("")
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.Compact())
+	stop()
+
+	count, err := db.CountRange(int642Bytes(0), int642Bytes(100))
+	require.NoError(t, err)
+	require.EqualValues(t, 50, count)
+}
+
+// setSqliteConcurrently keeps writing new keys to db from a few goroutines, so
+// that an auto-commit transaction keeps being reopened, until the returned
+// function is called.
+func setSqliteConcurrently(t *testing.T, db *SqliteDb) (stop func()) {
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				assert.NoError(t, db.Set([]byte(fmt.Sprintf("buffered-%d-%d", w, i)), []byte{1}))
+			}
+		}(w)
+	}
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func TestSqliteCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewSqliteDb("testdb", dir, nil)
+	require.NoError(t, err)
+	defer db.Close()
+	walSize := func() int64 {
+		info, err := os.Stat(filepath.Join(dir, "testdb"+DBFileSuffix+"-wal"))
+		require.NoError(t, err)
+		return info.Size()
+	}
+
+	value := bytes.Repeat([]byte{0xab}, 1024)
+	for i := int64(0); i < 500; i++ {
+		require.NoError(t, db.Set(int642Bytes(i), value))
+	}
+	before := walSize()
+	require.Greater(t, before, int64(500*1024))
+
+	res, err := db.Checkpoint("passive")
+	require.NoError(t, err)
+	require.False(t, res.Busy)
+	require.Positive(t, res.LogFrames)
+	require.Equal(t, res.LogFrames, res.Checkpointed)
+	require.Equal(t, before, walSize(), "a passive checkpoint keeps the WAL file")
+
+	res, err = db.Checkpoint("")
+	require.NoError(t, err)
+	require.False(t, res.Busy)
+	require.Zero(t, walSize())
+	checkValue(t, db, int642Bytes(42), value)
+
+	_, err = db.Checkpoint("EVERYTHING")
+	require.Error(t, err)
+
+	// Outside of WAL mode, there is nothing to do.
+	for _, opts := range []OptionsMap{{"journal_mode": "DELETE"}, {"in_memory": true}} {
+		db := newTestSqliteDb(t, opts)
+		require.NoError(t, db.Set([]byte("a"), []byte{1}))
+		res, err := db.Checkpoint("TRUNCATE")
+		require.NoError(t, err, opts)
+		require.Equal(t, SqliteCheckpoint{}, res)
+	}
+}
+
+func TestSqliteIteratorBounds(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	for i := byte(1); i <= 5; i++ {
+		require.NoError(t, db.Set([]byte{i}, []byte{i}))
+	}
+
+	testCases := []struct {
+		name       string
+		start, end []byte
+		reverse    bool
+		expect     []byte
+	}{
+		{"forward nil-nil", nil, nil, false, []byte{1, 2, 3, 4, 5}},
+		{"forward nil-end", nil, []byte{4}, false, []byte{1, 2, 3}},
+		{"forward start-nil", []byte{2}, nil, false, []byte{2, 3, 4, 5}},
+		{"forward start-end", []byte{2}, []byte{4}, false, []byte{2, 3}},
+		{"forward empty domain", []byte{3}, []byte{3}, false, nil},
+		{"forward bounds between keys", []byte{1, 0}, []byte{4, 0}, false, []byte{2, 3, 4}},
+		{"reverse nil-nil", nil, nil, true, []byte{5, 4, 3, 2, 1}},
+		{"reverse nil-end", nil, []byte{4}, true, []byte{3, 2, 1}},
+		{"reverse start-nil", []byte{2}, nil, true, []byte{5, 4, 3, 2}},
+		{"reverse start-end", []byte{2}, []byte{4}, true, []byte{3, 2}},
+		{"reverse empty domain", []byte{3}, []byte{3}, true, nil},
+		{"reverse bounds between keys", []byte{1, 0}, []byte{4, 0}, true, []byte{4, 3, 2}},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				itr Iterator
+				err error
+			)
+			if tc.reverse {
+				itr, err = db.ReverseIterator(tc.start, tc.end)
+			} else {
+				itr, err = db.Iterator(tc.start, tc.end)
+			}
+			require.NoError(t, err)
+			defer itr.Close()
+
+			var keys []byte
+			for ; itr.Valid(); itr.Next() {
+				require.Len(t, itr.Key(), 1)
+				keys = append(keys, itr.Key()[0])
+			}
+			require.NoError(t, itr.Error())
+			require.Equal(t, tc.expect, keys)
+		})
+	}
+}
+
+func TestSqliteIteratorExhausted(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	require.NoError(t, db.Set([]byte("a"), []byte{1}))
+	require.NoError(t, db.Set([]byte("b"), []byte{2}))
+
+	for _, reverse := range []bool{false, true} {
+		itr, err := db.newIterator(context.Background(), nil, nil, nil, reverse, 0)
+		require.NoError(t, err)
+		for i := 0; i < 2; i++ {
+			require.True(t, itr.Valid())
+			require.True(t, itr.Valid())
+			itr.Next()
+		}
+		// Valid keeps reporting the clean end of the scan.
+		for i := 0; i < 2; i++ {
+			require.False(t, itr.Valid())
+			require.NoError(t, itr.Error())
+		}
+		require.Panics(t, func() { itr.Key() })
+		require.NoError(t, itr.Close())
+		require.False(t, itr.Valid())
+		require.NoError(t, itr.Error())
+	}
+}
+
+func TestSqliteIteratorWithLimit(t *testing.T) {
+	db := newTestSqliteDb(t, nil)
+	for i := int64(0); i < 100; i++ {
+		require.NoError(t, db.Set(int642Bytes(i), []byte{1}))
+	}
+	page := func(itr Iterator, err error) [][]byte {
+		t.Helper()
+		require.NoError(t, err)
+		defer itr.Close()
+		var keys [][]byte
+		for ; itr.Valid(); itr.Next() {
+			keys = append(keys, itr.Key())
+		}
+		require.NoError(t, itr.Error())
+		return keys
+	}
+
+	keys := page(db.IteratorWithLimit(nil, nil, 10))
+	require.Len(t, keys, 10)
+	require.Equal(t, int642Bytes(0), keys[0])
+	require.Equal(t, int642Bytes(9), keys[9])
+
+	// Resume after the last key seen.
+	next := append(slices.Clone(keys[9]), 0)
+	keys = page(db.IteratorWithLimit(next, nil, 10))
+	require.Len(t, keys, 10)
+	require.Equal(t, int642Bytes(10), keys[0])
+	require.Equal(t, int642Bytes(19), keys[9])
+
+	keys = page(db.ReverseIteratorWithLimit(nil, nil, 10))
+	require.Len(t, keys, 10)
+	require.Equal(t, int642Bytes(99), keys[0])
+	keys = page(db.ReverseIteratorWithLimit(nil, keys[9], 10))
+	require.Len(t, keys, 10)
+	require.Equal(t, int642Bytes(89), keys[0])
+
+	// A limit past the end of the domain, or none at all, returns every key.
+	require.Len(t, page(db.IteratorWithLimit(int642Bytes(95), nil, 10)), 5)
+	require.Len(t, page(db.IteratorWithLimit(nil, nil, 0)), 100)
+	require.Len(t, page(db.IteratorWithLimit(nil, nil, -1)), 100)
+}
+
+func TestSqliteIteratorScanError(t *testing.T) {
+	errBad := errors.New("bad value")
+	db := newTestSqliteDb(t, OptionsMap{
+		"decode_value": func(stored []byte) ([]byte, bool, error) {
+			if bytes.Equal(stored, []byte("bad")) {
+				return nil, false, errBad
+			}
+			return stored, false, nil
+		},
+	})
+	require.NoError(t, db.Set([]byte("a"), []byte("good")))
+	require.NoError(t, db.Set([]byte("b"), []byte("bad")))
+	require.NoError(t, db.Set([]byte("c"), []byte("good")))
+
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	defer itr.Close()
+	require.True(t, itr.Valid())
+	require.Equal(t, []byte("a"), itr.Key())
+	itr.Next()
+
+	// The failed row leaves the iterator invalid, and Error reports why.
+	for i := 0; i < 2; i++ {
+		require.False(t, itr.Valid())
+		require.ErrorIs(t, itr.Error(), errBad)
+	}
+	require.Panics(t, func() { itr.Next() })
+	require.NoError(t, itr.Close())
+	require.ErrorIs(t, itr.Error(), errBad)
+}
+
+func TestSqliteDeleteRange(t *testing.T) {
+	testCases := []struct {
+		name       string
+		start, end []byte
+	}{
+		{"nil-nil", nil, nil},
+		{"nil-end", nil, []byte{4}},
+		{"start-nil", []byte{2}, nil},
+		{"start-end", []byte{2}, []byte{4}},
+		{"empty domain", []byte{3}, []byte{3}},
+		{"bounds between keys", []byte{1, 0}, []byte{4, 0}},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			cache := NewReadCache(1 << 20)
+			db := newTestSqliteDb(t, OptionsMap{"read_cache": cache})
+			expect := map[string][]byte{}
+			for i := byte(1); i <= 5; i++ {
+				require.NoError(t, db.Set([]byte{i}, []byte{i}))
+				checkValue(t, db, []byte{i}, []byte{i})
+				expect[string([]byte{i})] = []byte{i}
+			}
+			// Exactly the keys an iterator over the same bounds visits are
+			// deleted.
+			itr, err := db.Iterator(tc.start, tc.end)
+			require.NoError(t, err)
+			for ; itr.Valid(); itr.Next() {
+				delete(expect, string(itr.Key()))
+			}
+			require.NoError(t, itr.Close())
+
+			require.NoError(t, db.DeleteRange(tc.start, tc.end))
+			assertKeyValues(t, db, expect)
+			for i := byte(1); i <= 5; i++ {
+				checkValue(t, db, []byte{i}, expect[string([]byte{i})])
+			}
+		})
+	}
+
+	db := newTestSqliteDb(t, OptionsMap{"autocommit_ops": 100})
+	require.NoError(t, db.Set([]byte{1}, []byte{1}))
+	require.NoError(t, db.Set([]byte{2}, []byte{2}))
+	require.NoError(t, db.DeleteRange([]byte{2}, nil))
+	assertKeyValues(t, db, map[string][]byte{string([]byte{1}): {1}})
+	require.Equal(t, errKeyEmpty, db.DeleteRange([]byte{}, nil))
+	require.Equal(t, errKeyEmpty, db.DeleteRange(nil, []byte{}))
+}
+
+func TestSqliteHas(t *testing.T) {
+	for name, opts := range map[string]OptionsMap{
+		"default":             nil,
+		"separate read write": {"separate_read_write": true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db := newTestSqliteDb(t, opts)
+			require.NoError(t, db.Set([]byte("present"), []byte("value")))
+			require.NoError(t, db.Set([]byte("empty"), []byte{}))
+			snap, err := db.NewSnapshot()
+			require.NoError(t, err)
+			defer snap.Close()
+
+			for _, has := range []func([]byte) (bool, error){db.Has, snap.Has} {
+				for key, expect := range map[string]bool{"present": true, "empty": true, "absent": false} {
+					ok, err := has([]byte(key))
+					require.NoError(t, err, key)
+					require.Equal(t, expect, ok, key)
+				}
+				_, err := has([]byte{})
+				require.ErrorIs(t, err, errKeyEmpty)
+			}
+		})
+	}
+}
+
+func TestSqliteSeparateReadWrite(t *testing.T) {
+	for _, opts := range []OptionsMap{
+		{"separate_read_write": true, "in_memory": true},
+		{"separate_read_write": true, "read_only": true},
+	} {
+		_, err := NewSqliteDb("testdb", t.TempDir(), opts)
+		require.ErrorContains(t, err, "separate_read_write", opts)
+	}
+
+	// Without busy waits or retries, any contention fails right away.
+	db := newTestSqliteDb(t, OptionsMap{
+		"separate_read_write": true,
+		"busy_timeout":        0,
+		"busy_attempts":       1,
+	})
+	require.NotSame(t, db.db, db.reads)
+	_, err := db.reads.Exec(db.table.del, []byte("key"))
+	require.Error(t, err, "read connections must be read-only")
+	require.Equal(t, "1", db.Stats()["max_open_connections"])
+	require.Contains(t, db.Stats(), "reads.open_connections")
+
+	const (
+		writers = 4
+		readers = 16
+		keys    = 200
+	)
+	errs := make(chan error, writers+readers)
+	var (
+		wg   sync.WaitGroup
+		done = make(chan struct{})
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				key := []byte(fmt.Sprintf("%d/%03d", w, i))
+				if i%20 == 0 {
+					// Rewrite the last few keys in a batch.
+					batch := db.NewBatch()
+					for j := i - 5; j < i; j++ {
+						if j >= 0 {
+							_ = batch.Set([]byte(fmt.Sprintf("%d/%03d", w, j)), []byte{byte(j)})
+						}
+					}
+					if err := batch.Write(); err != nil {
+						errs <- err
+						return
+					}
+				}
+				if err := db.Set(key, []byte{byte(i)}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	var readWg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		readWg.Add(1)
+		go func(r int) {
+			defer readWg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				key := []byte(fmt.Sprintf("%d/%03d", r%writers, r))
+				if _, err := db.Get(key); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := db.Has(key); err != nil {
+					errs <- err
+					return
+				}
+				itr, err := db.Iterator(nil, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				for ; itr.Valid(); itr.Next() {
+				}
+				err = itr.Error()
+				if cerr := itr.Close(); err == nil {
+					err = cerr
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+	close(done)
+	readWg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	count, err := db.Count()
+	require.NoError(t, err)
+	require.EqualValues(t, writers*keys, count)
+	for w := 0; w < writers; w++ {
+		for _, i := range []int{0, 19, 100, keys - 1} {
+			checkValue(t, db, []byte(fmt.Sprintf("%d/%03d", w, i)), []byte{byte(i)})
+		}
+	}
+
+	// Namespaces and maintenance run on the same pair of pools.
+	ns, err := db.Namespace("other")
+	require.NoError(t, err)
+	require.NoError(t, ns.Set([]byte("key"), []byte{1}))
+	checkValue(t, ns, []byte("key"), []byte{1})
+	require.NoError(t, db.Compact())
+	checkValue(t, db, []byte("0/000"), []byte{0})
+}
+
+func TestSqliteObserver(t *testing.T) {
+	type observation struct {
+		op                 string
+		keySize, valueSize int
+		err                error
+	}
+	var (
+		mtx          sync.Mutex
+		observations []observation
+	)
+	observer := func(op string, d time.Duration, keySize, valueSize int, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		assert.GreaterOrEqual(t, d, time.Duration(0), op)
+		observations = append(observations, observation{op, keySize, valueSize, err})
+	}
+	db := newTestSqliteDb(t, OptionsMap{"observer": observer})
+
+	require.NoError(t, db.Set([]byte("key"), []byte("value")))
+	_, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.NoError(t, db.Delete([]byte("key")))
+	_, err = db.Get(nil)
+	require.ErrorIs(t, err, errKeyEmpty)
+	batch := db.NewBatch()
+	require.NoError(t, batch.Set([]byte("a"), []byte("1")))
+	require.NoError(t, batch.Set([]byte("bb"), []byte("22")))
+	require.NoError(t, batch.Delete([]byte("ccc")))
+	require.NoError(t, batch.Write())
+	itr, err := db.Iterator(nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, itr.Close())
+	require.NoError(t, db.SetSync([]byte("key"), []byte("v")))
+
+	require.Equal(t, []observation{
+		{"set", 3, 5, nil},
+		{"get", 3, 5, nil},
+		{"delete", 3, 0, nil},
+		{"get", 0, 0, errKeyEmpty},
+		{"batch_write", 6, 3, nil},
+		{"iterate", 0, 0, nil},
+		{"set", 3, 1, nil},
+	}, observations)
+
+	_, err = NewSqliteDb("testdb", t.TempDir(), OptionsMap{"observer": "prometheus"})
+	require.ErrorContains(t, err, "invalid observer")
+}
+
+func TestSqliteObserverAutoCommit(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		commits []error
+		sizes   [][2]int
+	)
+	observer := func(op string, d time.Duration, keySize, valueSize int, err error) {
+		if op != "autocommit" {
+			return
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		commits = append(commits, err)
+		sizes = append(sizes, [2]int{keySize, valueSize})
+	}
+	db := newTestSqliteDb(t, OptionsMap{"observer": observer, "autocommit_ops": 100})
+	ns, err := db.Namespace("blocks")
+	require.NoError(t, err)
+
+	require.NoError(t, db.Set([]byte("a"), []byte("1")))
+	require.NoError(t, ns.Set([]byte("bb"), []byte("22")))
+	require.NoError(t, db.Delete([]byte("ccc")))
+	require.NoError(t, db.Flush())
+	require.Equal(t, []error{nil}, commits)
+	require.Equal(t, [][2]int{{6, 3}}, sizes)
+
+	// A failed commit drops the buffered writes and is reported.
+	require.NoError(t, db.Set([]byte("d"), []byte("4")))
+	db.ac.mtx.Lock()
+	require.NoError(t, db.ac.tx.Rollback())
+	db.ac.mtx.Unlock()
+	require.ErrorIs(t, db.Flush(), sql.ErrTxDone)
+	require.Len(t, commits, 2)
+	require.ErrorIs(t, commits[1], sql.ErrTxDone)
+	checkValue(t, db, []byte("d"), nil)
+	checkValue(t, db, []byte("a"), []byte("1"))
+}
+
+func BenchmarkSqliteGet(b *testing.B) {
+	db, err := NewSqliteDb("testdb", b.TempDir(), nil)
+	require.NoError(b, err)
+	defer db.Close()
+
+	const numKeys = 1000
+	for i := int64(0); i < numKeys; i++ {
+		require.NoError(b, db.Set(int642Bytes(i), int642Bytes(i)))
+	}
+
+	// Preparing the lookup on every call, as Get used to.
+	b.Run("PreparePerCall", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			stmt, err := db.db.Prepare(db.table.get)
+			if err != nil {
+				b.Fatal(err)
+			}
+			var value []byte
+			if err := stmt.QueryRow(int642Bytes(int64(i % numKeys))).Scan(&value); err != nil {
+				b.Fatal(err)
+			}
+			stmt.Close()
+		}
+	})
+
+	b.Run("CachedStatement", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Get(int642Bytes(int64(i % numKeys))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSqliteHas(b *testing.B) {
+	db, err := NewSqliteDb("testdb", b.TempDir(), nil)
+	require.NoError(b, err)
+	defer db.Close()
+
+	key := []byte("key")
+	require.NoError(b, db.Set(key, bytes.Repeat([]byte{1}, 4<<20)))
+
+	// Reading the value to check that it exists, as Has used to.
+	b.Run("GetValue", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if value, err := db.Get(key); err != nil || value == nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Exists", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if ok, err := db.Has(key); err != nil || !ok {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkSqliteBatchSet(b *testing.B) {
+	db, err := NewSqliteDb("testdb", b.TempDir(), nil)
+	require.NoError(b, err)
+	defer db.Close()
+
+	const numOps = 10000
+	keys := make([][]byte, numOps)
+	for i := range keys {
+		keys[i] = int642Bytes(int64(i))
+	}
+	value := bytes.Repeat([]byte{1}, sqliteBatchOpSizeHint-8)
+
+	for _, bc := range []struct {
+		name     string
+		newBatch func() Batch
+	}{
+		{"Append", db.NewBatch},
+		{"Preallocated", func() Batch { return db.NewBatchWithSize(numOps * sqliteBatchOpSizeHint) }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				batch := bc.newBatch()
+				for _, key := range keys {
+					if err := batch.Set(key, value); err != nil {
+						b.Fatal(err)
+					}
+				}
+				batch.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkSqliteBatchWrite(b *testing.B) {
+	db, err := NewSqliteDb("testdb", b.TempDir(), nil)
+	require.NoError(b, err)
+	defer db.Close()
+
+	const numOps = 10000
+	keys := make([][]byte, numOps)
+	for i := range keys {
+		keys[i] = int642Bytes(int64(i))
+	}
+	value := bytes.Repeat([]byte{1}, sqliteBatchOpSizeHint-8)
+
+	// Executing one statement per operation, as Write used to.
+	b.Run("StatementPerOp", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tx, err := db.db.Begin()
+			if err != nil {
+				b.Fatal(err)
+			}
+			for _, key := range keys {
+				if _, err := tx.Exec(db.table.upsert, key, value, value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("MultiRow", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			batch := db.NewBatch()
+			for _, key := range keys {
+				if err := batch.Set(key, value); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := batch.Write(); err != nil {
+				b.Fatal(err)
+			}
+			batch.Close()
+		}
+	})
+}
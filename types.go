@@ -15,6 +15,12 @@ var (
 	errValueNil = errors.New("value cannot be nil")
 )
 
+// KV is a key-value pair.
+type KV struct {
+	Key   []byte
+	Value []byte
+}
+
 // DB is the main interface for all database backends. DBs are concurrency-safe. Callers must call
 // Close on the database when done.
 //
@@ -46,7 +52,7 @@ type DB interface {
 	// Iterator returns an iterator over a domain of keys, in ascending order. The caller must call
 	// Close when done. End is exclusive, and start must be less than end. A nil start iterates
 	// from the first key, and a nil end iterates to the last key (inclusive). Empty keys are not
-	// valid.
+	// valid: a start or end that is empty but not nil is rejected, see NormalizeBound.
 	// CONTRACT: No writes may happen within a domain while an iterator exists over it.
 	// CONTRACT: start, end readonly []byte
 	Iterator(start, end []byte) (Iterator, error)
@@ -54,7 +60,8 @@ type DB interface {
 	// ReverseIterator returns an iterator over a domain of keys, in descending order. The caller
 	// must call Close when done. End is exclusive, and start must be less than end. A nil end
 	// iterates from the last key (inclusive), and a nil start iterates to the first key (inclusive).
-	// Empty keys are not valid.
+	// Empty keys are not valid: a start or end that is empty but not nil is rejected, see
+	// NormalizeBound.
 	// CONTRACT: No writes may happen within a domain while an iterator exists over it.
 	// CONTRACT: start, end readonly []byte
 	ReverseIterator(start, end []byte) (Iterator, error)
@@ -157,3 +164,33 @@ type Iterator interface {
 	// Close closes the iterator, relasing any allocated resources.
 	Close() error
 }
+
+// Snapshot is a read-only view of a DB as of the moment it was taken: writes made afterwards,
+// through any handle, are not visible through it. Callers must call Close when done, which
+// releases the resources pinning the snapshot.
+//
+// As with DB, keys and values should be considered read-only, and must be copied before they are
+// modified.
+type Snapshot interface {
+	// Get fetches the value of the given key in the snapshot, or nil if it does not exist.
+	// CONTRACT: key, value readonly []byte
+	Get([]byte) ([]byte, error)
+
+	// Has checks if a key exists in the snapshot.
+	// CONTRACT: key, value readonly []byte
+	Has(key []byte) (bool, error)
+
+	// Iterator returns an iterator over a domain of keys of the snapshot, in ascending order, with
+	// the same domain semantics as DB.Iterator.
+	// CONTRACT: start, end readonly []byte
+	Iterator(start, end []byte) (Iterator, error)
+
+	// ReverseIterator returns an iterator over a domain of keys of the snapshot, in descending
+	// order, with the same domain semantics as DB.ReverseIterator.
+	// CONTRACT: start, end readonly []byte
+	ReverseIterator(start, end []byte) (Iterator, error)
+
+	// Close releases the snapshot and closes its open iterators. It is idempotent, but calls to
+	// other methods afterwards will error.
+	Close() error
+}
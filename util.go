@@ -2,7 +2,9 @@ package db
 
 import (
 	"bytes"
+	"database/sql"
 	"os"
+	"strconv"
 )
 
 func cp(bz []byte) (ret []byte) {
@@ -34,6 +36,25 @@ func cpIncr(bz []byte) (ret []byte) {
 	return nil
 }
 
+// isValidDomain reports whether start and end are valid iterator bounds. A nil
+// bound leaves its side of the domain unbounded, while an empty, non-nil one
+// is the empty key, which is not valid: iterators over such a domain fail with
+// errKeyEmpty rather than guess what was meant. See NormalizeBound.
+func isValidDomain(start, end []byte) bool {
+	return (start == nil || len(start) > 0) && (end == nil || len(end) > 0)
+}
+
+// NormalizeBound returns nil if bound is empty, and bound otherwise. Pass
+// iterator bounds that may be empty without meaning it, such as parts of a
+// key from bytes.Split, through it to leave that side of the domain unbounded
+// instead of failing with an empty key error.
+func NormalizeBound(bound []byte) []byte {
+	if len(bound) == 0 {
+		return nil
+	}
+	return bound
+}
+
 // See DB interface documentation for more information.
 func IsKeyInDomain(key, start, end []byte) bool {
 	if bytes.Compare(key, start) < 0 {
@@ -50,6 +71,32 @@ func FileExists(filePath string) bool {
 	return !os.IsNotExist(err)
 }
 
+// sqlDBStats returns the connection pool statistics of a database/sql backend
+// under these keys:
+//
+//	max_open_connections    maximum number of open connections, 0 if unlimited
+//	open_connections        established connections, in use or idle
+//	in_use                  connections currently in use
+//	idle                    idle connections
+//	wait_count              total number of times a caller waited for a connection
+//	wait_duration           total time spent waiting for a connection, in nanoseconds
+//	max_idle_closed         connections closed because of the idle pool limit
+//	max_idle_time_closed    connections closed because of the idle time limit
+//	max_lifetime_closed     connections closed because of the lifetime limit
+func sqlDBStats(stats sql.DBStats) map[string]string {
+	return map[string]string{
+		"max_open_connections": strconv.Itoa(stats.MaxOpenConnections),
+		"open_connections":     strconv.Itoa(stats.OpenConnections),
+		"in_use":               strconv.Itoa(stats.InUse),
+		"idle":                 strconv.Itoa(stats.Idle),
+		"wait_count":           strconv.FormatInt(stats.WaitCount, 10),
+		"wait_duration":        strconv.FormatInt(stats.WaitDuration.Nanoseconds(), 10),
+		"max_idle_closed":      strconv.FormatInt(stats.MaxIdleClosed, 10),
+		"max_idle_time_closed": strconv.FormatInt(stats.MaxIdleTimeClosed, 10),
+		"max_lifetime_closed":  strconv.FormatInt(stats.MaxLifetimeClosed, 10),
+	}
+}
+
 // OptionsMap is a stub implementing Options which can get data from a map
 type OptionsMap map[string]interface{}
 